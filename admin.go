@@ -0,0 +1,307 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AdminHandler returns an http.Handler serving p's admin endpoints:
+//
+//	GET /config
+//	    The running configuration; see DumpConfig.
+//	GET /explain?listener=ipPort&name=hostname
+//	    How the listener's routes handle hostname; see Explain.
+//	GET /audit?client=ip&name=hostname&limit=n
+//	    Recent routing decisions, newest first; see AuditSize. All
+//	    parameters are optional filters.
+//	POST /routes
+//	    Adds a route to a namespace. The body is a JSON AdminRoute;
+//	    the response holds the new route's id.
+//	DELETE /routes?namespace=name&id=routeId
+//	    Removes a namespace's route.
+//	POST /drain?group=name&member=id
+//	    Starts draining a member of a registered TargetGroup.
+//
+// If p.AdminDebug is set, it also serves:
+//
+//	GET /debug/vars
+//	    The process's expvar variables, plus a "tcpproxy" variable
+//	    with p's active connections, route counts and namespaces.
+//	GET /debug/pprof/
+//	    runtime/pprof profiles, in the format of net/http/pprof,
+//	    for use with go tool pprof.
+//
+// Responses are JSON. If p.AdminAuth is nil, the handler does no
+// authentication, so it should only be served on a trusted address.
+// Otherwise reading requires a Read grant, changing routes a
+// RouteWrite grant for the route's namespace, and draining a Drain
+// grant. The debug endpoints require a Debug grant.
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", p.requireGrant(canRead, p.serveConfig))
+	mux.HandleFunc("/explain", p.requireGrant(canRead, p.serveExplain))
+	mux.HandleFunc("/audit", p.requireGrant(canRead, p.serveAudit))
+	mux.HandleFunc("/routes", p.requireGrant(canWriteAny, p.serveRoutes))
+	mux.HandleFunc("/drain", p.requireGrant(canDrain, p.serveDrain))
+	if p.AdminDebug {
+		mux.HandleFunc("/debug/vars", p.requireGrant(canDebug, p.serveVars))
+		mux.HandleFunc("/debug/pprof/", p.requireGrant(canDebug, servePprof))
+	}
+	return mux
+}
+
+func (p *Proxy) serveAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.AuditSize <= 0 {
+		http.Error(w, "audit trail not enabled", http.StatusNotFound)
+		return
+	}
+	client, name := r.FormValue("client"), r.FormValue("name")
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+
+	ds := p.AuditTrail()
+	matched := []RoutingDecision{}
+	for i := len(ds) - 1; i >= 0 && (limit <= 0 || len(matched) < limit); i-- {
+		d := ds[i]
+		if client != "" {
+			if host, _, err := net.SplitHostPort(d.Client); err != nil || host != client {
+				continue
+			}
+		}
+		if name != "" && d.HostName != name {
+			continue
+		}
+		matched = append(matched, d)
+	}
+	writeJSON(w, matched)
+}
+
+// An AdminRoute is a route added through the admin API.
+type AdminRoute struct {
+	Namespace string `json:"namespace"`
+	Listener  string `json:"listener"`
+	Kind      string `json:"kind"` // "sni" or "http"
+	Name      string `json:"name"` // SNI server name or HTTP Host
+	Addr      string `json:"addr"` // backend address, proxied to with To
+}
+
+func (p *Proxy) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	var ar AdminRoute
+	switch r.Method {
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&ar); err != nil {
+			http.Error(w, "bad route: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "DELETE":
+		ar.Namespace = r.FormValue("namespace")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ar.Namespace == "" {
+		http.Error(w, "missing namespace", http.StatusBadRequest)
+		return
+	}
+	if grant, _ := p.adminGrant(r); !grant.canWriteRoutes(ar.Namespace) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		id, err := uuid.Parse(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "bad route id", http.StatusBadRequest)
+			return
+		}
+		err = fmt.Errorf("tcpproxy: route %v not in namespace %q", id, ar.Namespace)
+		if ns := p.lookupNamespace(ar.Namespace); ns != nil {
+			err = ns.RemoveRoute(id)
+		}
+		if err != nil && !p.forgetUnrestored(ar.Namespace, id) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := p.logRouteChange(journalEntry{Op: "remove", Id: id}); err != nil {
+			log.Printf("tcpproxy: journaling removal of route %v: %v", id, err)
+			http.Error(w, "route removed but not persisted", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	id, err := p.addAdminRoute(&ar, uuid.New())
+	if err != nil {
+		code := http.StatusBadRequest
+		if _, ok := err.(quotaError); ok {
+			code = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if err := p.logRouteChange(journalEntry{Op: "add", Id: id, Route: &ar}); err != nil {
+		// Don't keep a route that would vanish on restart.
+		log.Printf("tcpproxy: journaling route %v: %v", id, err)
+		p.lookupNamespace(ar.Namespace).RemoveRoute(id)
+		http.Error(w, "route not persisted", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Id uuid.UUID `json:"id"`
+	}{id})
+}
+
+// addAdminRoute adds the route described by ar to its namespace,
+// with id routeId. The namespace and listener must already be
+// configured by the operator; the admin API can't create either.
+func (p *Proxy) addAdminRoute(ar *AdminRoute, routeId uuid.UUID) (uuid.UUID, error) {
+	if ar.Namespace == "" || ar.Listener == "" || ar.Name == "" || ar.Addr == "" {
+		return uuid.Nil, errors.New("route needs namespace, listener, name and addr")
+	}
+	if !p.hasListener(ar.Listener) {
+		return uuid.Nil, fmt.Errorf("unknown listener %q", ar.Listener)
+	}
+	ns := p.lookupNamespace(ar.Namespace)
+	if ns == nil {
+		return uuid.Nil, fmt.Errorf("unknown namespace %q", ar.Namespace)
+	}
+	switch ar.Kind {
+	case "sni":
+		return ns.addSNIRoute(ar.Listener, ar.Name, To(ar.Addr), routeId)
+	case "http":
+		return ns.addHTTPHostRoute(ar.Listener, ar.Name, To(ar.Addr), routeId)
+	}
+	return uuid.Nil, fmt.Errorf("unknown route kind %q", ar.Kind)
+}
+
+func (p *Proxy) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.Lock()
+	g := p.groups[r.FormValue("group")]
+	p.mu.Unlock()
+	if g == nil {
+		http.Error(w, "unknown target group", http.StatusNotFound)
+		return
+	}
+	id, err := uuid.Parse(r.FormValue("member"))
+	if err != nil {
+		http.Error(w, "bad member id", http.StatusBadRequest)
+		return
+	}
+	g.Drain(id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// RegisterTargetGroup makes g's members drainable through the admin
+// API under name.
+func (p *Proxy) RegisterTargetGroup(name string, g *TargetGroup) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.groups == nil {
+		p.groups = make(map[string]*TargetGroup)
+	}
+	p.groups[name] = g
+}
+
+func (p *Proxy) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, p.DumpConfig())
+}
+
+func (p *Proxy) serveExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	listener, name := r.FormValue("listener"), r.FormValue("name")
+	if listener == "" {
+		http.Error(w, "missing listener parameter", http.StatusBadRequest)
+		return
+	}
+	ex, err := p.Explain(listener, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, ex)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("tcpproxy: writing admin response: %v", err)
+	}
+}
+
+// startAdmin serves AdminHandler on p.AdminAddr, if set.
+func (p *Proxy) startAdmin() error {
+	if p.AdminAddr == "" {
+		return nil
+	}
+	if p.AdminAuth != nil && len(p.AdminAuth.Tokens) > 0 && p.AdminTLSConfig == nil && !isLoopbackAddr(p.AdminAddr) {
+		return fmt.Errorf("tcpproxy: admin tokens would be sent in plaintext to %s; set AdminTLSConfig or use a loopback AdminAddr", p.AdminAddr)
+	}
+	ln, err := net.Listen("tcp", p.AdminAddr)
+	if err != nil {
+		return err
+	}
+	if p.AdminTLSConfig != nil {
+		ln = tls.NewListener(ln, p.AdminTLSConfig)
+	}
+	srv := &http.Server{
+		Handler:           p.AdminHandler(),
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+		ReadTimeout:       adminReadTimeout,
+		IdleTimeout:       adminIdleTimeout,
+	}
+	p.mu.Lock()
+	p.adminLn = ln
+	p.adminSrv = srv
+	p.mu.Unlock()
+	go srv.Serve(ln)
+	return nil
+}
+
+// Timeouts for admin API connections, so that slow or idle clients
+// can't tie up the admin server. There's no write timeout, since
+// /debug/pprof/profile and trace take as long as the client asks.
+const (
+	adminReadHeaderTimeout = 10 * time.Second
+	adminReadTimeout       = 30 * time.Second
+	adminIdleTimeout       = 2 * time.Minute
+)
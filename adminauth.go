@@ -0,0 +1,141 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AdminAuth specifies the credentials accepted by AdminHandler and
+// what each may do. Requests are authenticated by a bearer token in
+// the Authorization header, or by a verified TLS client certificate
+// when the admin listener uses TLS (see Proxy.AdminTLSConfig).
+//
+// Start refuses to serve tokens in plaintext: with Tokens set, the
+// AdminAddr listener must use TLS or listen only on loopback.
+type AdminAuth struct {
+	// Tokens maps bearer tokens to their grants.
+	Tokens map[string]AdminGrant
+
+	// ClientCerts maps the subject common names of verified client
+	// certificates to their grants.
+	ClientCerts map[string]AdminGrant
+}
+
+// An AdminGrant is the set of admin operations a credential may
+// perform.
+type AdminGrant struct {
+	// Read allows reading the configuration and explaining routes.
+	Read bool
+
+	// RouteWrite lists the namespaces whose routes may be added
+	// and removed. The name "*" allows all namespaces.
+	RouteWrite []string
+
+	// Drain allows draining target group members.
+	Drain bool
+
+	// Debug allows profiling the proxy and reading its variables,
+	// if Proxy.AdminDebug is set.
+	Debug bool
+}
+
+// fullGrant is the grant of requests when no AdminAuth is configured.
+var fullGrant = AdminGrant{Read: true, RouteWrite: []string{"*"}, Drain: true, Debug: true}
+
+// canWriteRoutes reports whether g allows changing the routes of
+// namespace.
+func (g AdminGrant) canWriteRoutes(namespace string) bool {
+	for _, ns := range g.RouteWrite {
+		if ns == "*" || ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// adminGrant returns the grant of r's credentials, or false if r
+// has no valid credentials.
+func (p *Proxy) adminGrant(r *http.Request) (AdminGrant, bool) {
+	auth := p.AdminAuth
+	if auth == nil {
+		return fullGrant, true
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		digest := sha256.Sum256([]byte(strings.TrimPrefix(h, "Bearer ")))
+		var (
+			grant AdminGrant
+			found bool
+		)
+		// Compare digests against every token's in constant time.
+		// ConstantTimeCompare returns early on a length mismatch, so
+		// comparing the tokens themselves would reveal their lengths;
+		// the digests are all the same length.
+		for t, g := range auth.Tokens {
+			want := sha256.Sum256([]byte(t))
+			if subtle.ConstantTimeCompare(digest[:], want[:]) == 1 {
+				grant, found = g, true
+			}
+		}
+		return grant, found
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		grant, ok := auth.ClientCerts[cn]
+		return grant, ok
+	}
+	return AdminGrant{}, false
+}
+
+// requireGrant wraps h so it is only served to requests whose grant
+// satisfies allowed.
+func (p *Proxy) requireGrant(allowed func(AdminGrant) bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		grant, ok := p.adminGrant(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !allowed(grant) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func canRead(g AdminGrant) bool     { return g.Read }
+func canDrain(g AdminGrant) bool    { return g.Drain }
+func canDebug(g AdminGrant) bool    { return g.Debug }
+func canWriteAny(g AdminGrant) bool { return len(g.RouteWrite) > 0 }
+
+// isLoopbackAddr reports whether the TCP listen address addr listens
+// only on a loopback interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAdminAuth(t *testing.T) {
+	p := &Proxy{AdminAuth: &AdminAuth{
+		Tokens: map[string]AdminGrant{
+			"reader": {Read: true},
+			"team-a": {RouteWrite: []string{"team-a"}},
+		},
+		ClientCerts: map[string]AdminGrant{
+			"ops": {Read: true, RouteWrite: []string{"*"}, Drain: true},
+		},
+	}}
+	p.configFor(":443")
+	p.Namespace("team-a").SetScope(NamespaceScope{
+		Listeners: []string{":443"},
+		Suffixes:  []string{"example.com"},
+		Backends:  []string{"10.0.0.0/8"},
+	})
+	h := p.AdminHandler()
+	do := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		switch {
+		case token == "cert:ops":
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: "ops"}},
+			}}}
+		case token != "":
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	const route = `{"namespace":"team-a","listener":":443","kind":"sni","name":"a.example.com","addr":"10.0.0.1:443"}`
+
+	tests := []struct {
+		method, url, token, body string
+		want                     int
+	}{
+		{"GET", "/config", "", "", http.StatusUnauthorized},
+		{"GET", "/config", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/config", "reader", "", http.StatusOK},
+		{"GET", "/config", "team-a", "", http.StatusForbidden},
+		{"GET", "/config", "cert:ops", "", http.StatusOK},
+		{"POST", "/routes", "reader", route, http.StatusForbidden},
+		{"POST", "/routes", "team-a", strings.Replace(route, "team-a", "team-b", 1), http.StatusForbidden},
+		{"POST", "/routes", "team-a", strings.Replace(route, ":443", ":8443", 1), http.StatusBadRequest},
+		{"POST", "/routes", "team-a", strings.Replace(route, "10.0.0.1", "192.168.0.1", 1), http.StatusForbidden},
+		{"POST", "/routes", "cert:ops", strings.Replace(route, "team-a", "team-c", 1), http.StatusBadRequest},
+		{"DELETE", "/routes?namespace=team-c&id=" + uuid.New().String(), "cert:ops", "", http.StatusNotFound},
+		{"POST", "/routes", "team-a", route, http.StatusOK},
+		{"POST", "/drain?group=web&member=" + uuid.New().String(), "team-a", "", http.StatusForbidden},
+		{"POST", "/drain?group=web&member=" + uuid.New().String(), "cert:ops", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := do(tt.method, tt.url, tt.token, tt.body); rec.Code != tt.want {
+			t.Errorf("%s %s as %q = %d; want %d", tt.method, tt.url, tt.token, rec.Code, tt.want)
+		}
+	}
+	if n := p.Namespace("team-a").Stats().Routes; n != 1 {
+		t.Fatalf("team-a has %d routes; want 1", n)
+	}
+	if p.lookupNamespace("team-c") != nil {
+		t.Error("POST /routes created an unconfigured namespace")
+	}
+}
+
+func TestAdminRoutesAndDrain(t *testing.T) {
+	var p Proxy
+	g := new(TargetGroup)
+	member := g.Add(noopTarget{}, 1)
+	p.RegisterTargetGroup("web", g)
+	p.configFor(":80")
+	p.Namespace("team-a").SetScope(NamespaceScope{
+		Listeners: []string{":80"},
+		Suffixes:  []string{"example.com"},
+		Backends:  []string{"10.0.0.0/8"},
+	})
+	h := p.AdminHandler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/routes", strings.NewReader(
+		`{"namespace":"team-a","listener":":80","kind":"http","name":"a.example.com","addr":"10.0.0.1:80"}`)))
+	var added struct{ Id uuid.UUID }
+	if err := json.NewDecoder(rec.Body).Decode(&added); err != nil {
+		t.Fatalf("decoding add response %d: %v", rec.Code, err)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("DELETE", "/routes?namespace=team-a&id="+added.Id.String(), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE /routes = %d; want %d", rec.Code, http.StatusNoContent)
+	}
+	if n := len(p.configFor(":80").Routes()); n != 0 {
+		t.Errorf("listener has %d routes after delete; want 0", n)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/drain?group=web&member="+member.String(), nil))
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("POST /drain = %d; want %d", rec.Code, http.StatusAccepted)
+	}
+	if n := len(g.Members()); n != 0 {
+		t.Errorf("group has %d members after drain; want 0", n)
+	}
+}
+
+func TestAdminTokensRequireTLS(t *testing.T) {
+	tests := []struct {
+		addr   string
+		tls    bool
+		wantOK bool
+	}{
+		{"127.0.0.1:0", false, true},
+		{"localhost:0", false, true},
+		{":0", false, false},
+		{"0.0.0.0:0", false, false},
+		{":0", true, true},
+	}
+	for _, tt := range tests {
+		p := &Proxy{
+			AdminAddr: tt.addr,
+			AdminAuth: &AdminAuth{Tokens: map[string]AdminGrant{"secret": {Read: true}}},
+		}
+		if tt.tls {
+			p.AdminTLSConfig = &tls.Config{}
+		}
+		err := p.startAdmin()
+		if (err == nil) != tt.wantOK {
+			t.Errorf("startAdmin on %s with TLS %v = %v; want ok=%v", tt.addr, tt.tls, err, tt.wantOK)
+		}
+		if p.adminSrv != nil {
+			p.adminSrv.Close()
+		}
+	}
+}
+
+func TestAdminServerClose(t *testing.T) {
+	p := &Proxy{AdminAddr: "127.0.0.1:0"}
+	if err := p.startAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	if p.adminSrv.ReadHeaderTimeout <= 0 || p.adminSrv.ReadTimeout <= 0 || p.adminSrv.IdleTimeout <= 0 {
+		t.Errorf("admin server timeouts = %v, %v, %v; want all set",
+			p.adminSrv.ReadHeaderTimeout, p.adminSrv.ReadTimeout, p.adminSrv.IdleTimeout)
+	}
+
+	c, err := net.Dial("tcp", p.adminLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET /config HTTP/1.1\r\nHost: admin\r\n\r\n")
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+
+	// Close shuts down the kept-alive connection too.
+	p.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("reading idle admin conn after Close: %v; want EOF", err)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A RoutingDecision records how the proxy routed one connection.
+type RoutingDecision struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"` // remote address
+	Local  string    `json:"local"`  // address the client connected to
+
+	// HostName is the SNI or HTTP Host name the client sent, if
+	// any.
+	HostName string `json:"hostName,omitempty"`
+
+	// RouteId is the id of the matched route. It is uuid.Nil if
+	// the connection went to the default target or was dropped.
+	RouteId uuid.UUID `json:"routeId"`
+
+	// Target describes where the connection was sent, or is empty
+	// if it was dropped.
+	Target string `json:"target,omitempty"`
+
+	// Miss says why the connection matched no route, if it didn't.
+	Miss MissReason `json:"miss,omitempty"`
+}
+
+// auditTrail is a ring buffer of the most recent RoutingDecisions.
+type auditTrail struct {
+	mu   sync.Mutex
+	buf  []RoutingDecision
+	next int  // index of the slot to write next
+	full bool // whether buf has wrapped
+}
+
+func (a *auditTrail) add(d RoutingDecision) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.buf[a.next] = d
+	a.next++
+	if a.next == len(a.buf) {
+		a.next, a.full = 0, true
+	}
+}
+
+// decisions returns the recorded decisions, oldest first.
+func (a *auditTrail) decisions() []RoutingDecision {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.full {
+		return append([]RoutingDecision(nil), a.buf[:a.next]...)
+	}
+	ds := make([]RoutingDecision, 0, len(a.buf))
+	ds = append(ds, a.buf[a.next:]...)
+	return append(ds, a.buf[:a.next]...)
+}
+
+// audit returns p's audit trail, or nil if AuditSize is zero.
+func (p *Proxy) audit() *auditTrail {
+	if p.AuditSize <= 0 {
+		return nil
+	}
+	p.auditOnce.Do(func() {
+		p.auditTrail = &auditTrail{buf: make([]RoutingDecision, p.AuditSize)}
+	})
+	return p.auditTrail
+}
+
+// AuditTrail returns the most recent routing decisions, oldest
+// first, or nil if p.AuditSize is zero.
+func (p *Proxy) AuditTrail() []RoutingDecision {
+	if a := p.audit(); a != nil {
+		return a.decisions()
+	}
+	return nil
+}
+
+// recordDecision adds a decision about c to the audit trail, if
+// enabled. If hostName is empty, the bytes already buffered in br are
+// examined for a name to record; br is never read from, so this
+// doesn't block.
+func (p *Proxy) recordDecision(c net.Conn, br *bufio.Reader, hostName string, routeId uuid.UUID, target Target, miss MissReason) {
+	a := p.audit()
+	if a == nil {
+		return
+	}
+	if hostName == "" && br != nil && br.Buffered() > 0 {
+		peeked, _ := br.Peek(br.Buffered())
+		buffered := bufio.NewReader(bytes.NewReader(peeked))
+		if hostName = clientHelloServerName(buffered); hostName == "" {
+			hostName = httpHostHeader(buffered)
+		}
+	}
+	d := RoutingDecision{
+		Time:     time.Now(),
+		Client:   c.RemoteAddr().String(),
+		Local:    c.LocalAddr().String(),
+		HostName: hostName,
+		RouteId:  routeId,
+		Miss:     miss,
+	}
+	if target != nil {
+		d.Target = describeTarget(target)
+	}
+	a.add(d)
+}
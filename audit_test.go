@@ -0,0 +1,63 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAuditTrail(t *testing.T) {
+	p := &Proxy{AuditSize: 2}
+	id := p.AddHTTPHostRoute(testFrontAddr, "foo.com", noopTarget{})
+	cfg := p.configFor(testFrontAddr)
+
+	serve := func(ip, host string) {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+			client.Close()
+		}()
+		p.serveConn(remoteAddrConn{server, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}, cfg)
+	}
+	serve("192.0.2.1", "foo.com")
+	serve("192.0.2.2", "foo.com")
+	serve("192.0.2.3", "bar.com")
+
+	ds := p.AuditTrail()
+	if len(ds) != 2 {
+		t.Fatalf("got %d decisions; want the last 2", len(ds))
+	}
+	if d := ds[0]; d.Client != "192.0.2.2:1234" || d.RouteId != id || d.HostName != "foo.com" || d.Miss != "" {
+		t.Errorf("first decision = %+v; want match of route %v", d, id)
+	}
+	if d := ds[1]; d.Client != "192.0.2.3:1234" || d.RouteId != uuid.Nil || d.HostName != "bar.com" || d.Miss != MissNoRouteMatched {
+		t.Errorf("second decision = %+v; want miss for bar.com", d)
+	}
+
+	rec := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/audit?client=192.0.2.2", nil))
+	var got []RoutingDecision
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding /audit: %v\n%s", err, rec.Body)
+	}
+	if len(got) != 1 || got[0].Client != "192.0.2.2:1234" {
+		t.Errorf("/audit?client=192.0.2.2 = %+v", got)
+	}
+}
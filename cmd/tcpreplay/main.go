@@ -0,0 +1,100 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The tcpreplay command replays the client side of a connection
+// recorded by tcpproxy.RecordTarget against a backend, printing what
+// the backend sends back alongside what was originally recorded.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/patdowney/tcpproxy"
+)
+
+var (
+	addr    = flag.String("addr", "", "backend address to replay against")
+	timing  = flag.Bool("timing", false, "preserve the recorded delays between client chunks")
+	timeout = flag.Duration("timeout", 5*time.Second, "how long to wait for each server chunk")
+)
+
+func main() {
+	flag.Parse()
+	if *addr == "" || flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: tcpreplay -addr host:port recording.rec\n")
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to open recording: %s", err)
+	}
+	chunks, err := tcpproxy.ReadRecording(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Failed to read recording %q: %s", flag.Arg(0), err)
+	}
+
+	conn, err := net.DialTimeout("tcp", *addr, 10*time.Second)
+	if err != nil {
+		log.Fatalf("Failed to dial %q: %s", *addr, err)
+	}
+	defer conn.Close()
+
+	if err := replay(conn, chunks); err != nil {
+		log.Fatalf("Replay failed: %s", err)
+	}
+}
+
+// replay sends the client chunks to conn in order. Before sending
+// each client chunk, it waits for as many bytes as the server sent
+// in the recording, so interactive negotiations stay in step.
+func replay(conn net.Conn, chunks []tcpproxy.RecordedChunk) error {
+	start := time.Now()
+	for _, c := range chunks {
+		switch c.Dir {
+		case tcpproxy.FromClient:
+			if *timing {
+				time.Sleep(c.Offset - time.Since(start))
+			}
+			log.Printf("C: %q", c.Data)
+			if _, err := conn.Write(c.Data); err != nil {
+				return fmt.Errorf("writing client chunk: %s", err)
+			}
+		case tcpproxy.FromServer:
+			if err := conn.SetReadDeadline(time.Now().Add(*timeout)); err != nil {
+				return err
+			}
+			got := make([]byte, len(c.Data))
+			n, err := io.ReadFull(conn, got)
+			got = got[:n]
+			if !bytes.Equal(got, c.Data) {
+				log.Printf("S: %q (recorded %q)", got, c.Data)
+			} else {
+				log.Printf("S: %q", got)
+			}
+			if err != nil {
+				return fmt.Errorf("reading server chunk: %s", err)
+			}
+		}
+	}
+	return nil
+}
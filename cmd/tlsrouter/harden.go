@@ -0,0 +1,93 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	runAsUser     = flag.String("user", "", "after listening, switch to this user")
+	runAsGroup    = flag.String("group", "", "after listening, switch to this group (default: the user's primary group)")
+	chrootDir     = flag.String("chroot", "", "after listening, chroot to this directory")
+	landlock      = flag.Bool("landlock", false, "after listening, deny all filesystem access except -landlock-allow paths (Linux 5.13+)")
+	landlockAllow = flag.String("landlock-allow", "/etc/resolv.conf,/etc/hosts", "comma-separated paths left readable by -landlock, relative to -chroot if set")
+)
+
+// hardening describes how the daemon restricts itself once its
+// listener is open.
+type hardening struct {
+	uid, gid      int // -1 to keep the current ids
+	chroot        string
+	landlock      bool
+	landlockAllow []string
+}
+
+// enabled reports whether h restricts anything.
+func (h *hardening) enabled() bool {
+	return h.uid >= 0 || h.gid >= 0 || h.chroot != "" || h.landlock
+}
+
+// hardeningFromFlags builds a hardening from the command line flags.
+// User and group names are resolved now, since they may not be
+// resolvable after chrooting.
+func hardeningFromFlags() (*hardening, error) {
+	h := &hardening{
+		uid:      -1,
+		gid:      -1,
+		chroot:   *chrootDir,
+		landlock: *landlock,
+	}
+	if h.chroot != "" && !filepath.IsAbs(h.chroot) {
+		return nil, fmt.Errorf("chroot directory %q is not absolute", h.chroot)
+	}
+	if *runAsGroup != "" && *runAsUser == "" {
+		return nil, errors.New("-group requires -user")
+	}
+	if *runAsUser != "" {
+		u, err := user.Lookup(*runAsUser)
+		if err != nil {
+			return nil, err
+		}
+		gid := u.Gid
+		if *runAsGroup != "" {
+			g, err := user.LookupGroup(*runAsGroup)
+			if err != nil {
+				return nil, err
+			}
+			gid = g.Gid
+		}
+		if h.uid, err = strconv.Atoi(u.Uid); err != nil {
+			return nil, fmt.Errorf("non-numeric uid %q for user %q", u.Uid, u.Username)
+		}
+		if h.gid, err = strconv.Atoi(gid); err != nil {
+			return nil, fmt.Errorf("non-numeric gid %q", gid)
+		}
+	}
+	if h.landlock {
+		for _, p := range strings.Split(*landlockAllow, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				h.landlockAllow = append(h.landlockAllow, p)
+			}
+		}
+	}
+	return h, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && go1.16
+// +build linux,go1.16
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// apply restricts the process as described by h: chroot first,
+// while still privileged, then drop the user and group ids, then
+// give up filesystem access with landlock.
+//
+// It needs Go 1.16, whose syscall.Setuid and Setgid change the ids
+// of all threads, and whose syscall.AllThreadsSyscall lets landlock
+// restrict all threads rather than only the calling one.
+func (h *hardening) apply() error {
+	if h.chroot != "" {
+		if err := syscall.Chroot(h.chroot); err != nil {
+			return fmt.Errorf("chroot to %q: %s", h.chroot, err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return fmt.Errorf("chdir after chroot: %s", err)
+		}
+	}
+	if h.gid >= 0 {
+		if err := syscall.Setgroups(nil); err != nil {
+			return fmt.Errorf("clear supplementary groups: %s", err)
+		}
+		if err := syscall.Setgid(h.gid); err != nil {
+			return fmt.Errorf("setgid %d: %s", h.gid, err)
+		}
+	}
+	if h.uid >= 0 {
+		if err := syscall.Setuid(h.uid); err != nil {
+			return fmt.Errorf("setuid %d: %s", h.uid, err)
+		}
+	}
+	if h.landlock {
+		if err := landlockRestrict(h.landlockAllow); err != nil {
+			return fmt.Errorf("landlock: %s", err)
+		}
+	}
+	return nil
+}
+
+// Landlock syscall numbers and constants, from linux/landlock.h.
+// The syscall numbers are the same on all architectures.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	landlockAccessFSReadFile = 1 << 2
+	landlockAccessFSReadDir  = 1 << 3
+	landlockAccessFSRefer    = 1 << 13 // ABI 2
+	landlockAccessFSTruncate = 1 << 14 // ABI 3
+
+	// All filesystem rights of ABI 1.
+	landlockAccessFSV1 = 1<<13 - 1
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000 // O_PATH on most architectures; missing from package syscall
+)
+
+var errLandlockCgo = errors.New("not supported in binaries built with cgo; rebuild with CGO_ENABLED=0")
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// landlockPathBeneathAttr matches the packed kernel struct; Go's
+// trailing padding is not read by the kernel.
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// landlockRestrict denies the process all filesystem access, except
+// reading the files and directories in allow.
+func landlockRestrict(allow []string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("not supported by this kernel: %s", errno)
+	}
+	attr := landlockRulesetAttr{handledAccessFS: landlockAccessFSV1}
+	if abi >= 2 {
+		attr.handledAccessFS |= landlockAccessFSRefer
+	}
+	if abi >= 3 {
+		attr.handledAccessFS |= landlockAccessFSTruncate
+	}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("create ruleset: %s", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	for _, path := range allow {
+		if err := landlockAllowRead(int(fd), path); err != nil {
+			log.Printf("landlock: not allowing %q: %s", path, err)
+		}
+	}
+
+	// Both calls only affect the calling thread, so they must be
+	// made on every thread of the runtime. AllThreadsSyscall does
+	// that, but isn't available in binaries built with cgo.
+	if _, _, errno := syscall.AllThreadsSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return errLandlockCgo
+		}
+		return fmt.Errorf("set no_new_privs: %s", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("restrict self: %s", errno)
+	}
+	return nil
+}
+
+func landlockAllowRead(rulesetFd int, path string) error {
+	f, err := os.OpenFile(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	rule := landlockPathBeneathAttr{
+		allowedAccess: landlockAccessFSReadFile,
+		parentFd:      int32(f.Fd()),
+	}
+	if fi.IsDir() {
+		rule.allowedAccess |= landlockAccessFSReadDir
+	}
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(rulesetFd), landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && go1.16
+// +build linux,go1.16
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestLandlock restricts a child test process, since landlock can't
+// be undone.
+func TestLandlock(t *testing.T) {
+	if dir := os.Getenv("TLSROUTER_LANDLOCK_DIR"); dir != "" {
+		landlockChild(dir)
+		return
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion); errno != 0 {
+		t.Skipf("landlock not available: %s", errno)
+	}
+
+	dir, err := ioutil.TempDir("", "tlsrouter-landlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"allowed", "denied"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLandlock$")
+	cmd.Env = append(os.Environ(), "TLSROUTER_LANDLOCK_DIR="+dir)
+	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), errLandlockCgo.Error()) {
+		t.Skip("landlock needs a binary built without cgo")
+	}
+	if err != nil {
+		t.Fatalf("restricted child failed: %s\n%s", err, out)
+	}
+}
+
+func landlockChild(dir string) {
+	fail := func(msg string) {
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(1)
+	}
+	// Park a goroutine on another OS thread that exists before the
+	// restriction, to check that the restriction covers it too.
+	runtime.LockOSThread()
+	other := make(chan func())
+	otherDone := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		(<-other)()
+		close(otherDone)
+	}()
+
+	if err := landlockRestrict([]string{filepath.Join(dir, "allowed")}); err != nil {
+		fail("landlockRestrict: " + err.Error())
+	}
+	other <- func() {
+		if _, err := ioutil.ReadFile(filepath.Join(dir, "denied")); err == nil {
+			fail("read denied file from another thread")
+		}
+	}
+	<-otherDone
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "allowed")); err != nil {
+		fail("reading allowed file: " + err.Error())
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "denied")); err == nil {
+		fail("read denied file")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "allowed"), nil, 0644); err == nil {
+		fail("wrote allowed file")
+	}
+}
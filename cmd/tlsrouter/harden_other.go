@@ -0,0 +1,26 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux || !go1.16
+// +build !linux !go1.16
+
+package main
+
+import "errors"
+
+// apply reports an error, since hardening is only implemented on
+// Linux, and needs Go 1.16 to apply to all threads.
+func (h *hardening) apply() error {
+	return errors.New("-user, -group, -chroot and -landlock are only supported on linux, in binaries built with Go 1.16 or later")
+}
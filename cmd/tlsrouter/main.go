@@ -38,8 +38,23 @@ func main() {
 	if err := p.Config.ReadFile(*cfgFile); err != nil {
 		log.Fatalf("Failed to read config %q: %s", *cfgFile, err)
 	}
+	h, err := hardeningFromFlags()
+	if err != nil {
+		log.Fatalf("Invalid hardening flags: %s", err)
+	}
+
+	// Listen before hardening, so privileged ports can be bound.
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("create listener: %s", err)
+	}
+	if h.enabled() {
+		if err := h.apply(); err != nil {
+			log.Fatalf("Hardening failed: %s", err)
+		}
+	}
 
-	log.Fatalf("%s", p.ListenAndServe(*listen))
+	log.Fatalf("%s", p.Serve(l))
 }
 
 // Proxy routes connections to backends based on a Config.
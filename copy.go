@@ -0,0 +1,191 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// CopyStats describes the traffic copied in one direction of a
+// proxied connection.
+type CopyStats struct {
+	Bytes int64 // bytes written to the receiving side
+	Reads int64 // successful reads from the sending side, roughly its packets
+}
+
+// ConnStats describes the traffic of a connection proxied by a
+// DialProxy.
+type ConnStats struct {
+	FromClient CopyStats // client to backend
+	FromServer CopyStats // backend to client
+	Duration   time.Duration
+	Stalls     int  // number of times either direction stalled
+	IdleClosed bool // whether the connection was closed by IdleTimeout
+}
+
+// instrumented reports whether dp needs the instrumented copier
+// rather than plain io.Copy.
+func (dp *DialProxy) instrumented() bool {
+	return dp.StallTimeout > 0 || dp.IdleTimeout > 0 || dp.OnCopyDone != nil
+}
+
+// copyDir is the state of one direction of an instrumented copy.
+type copyDir struct {
+	dir byte // FromClient or FromServer
+
+	// Updated atomically.
+	bytes, reads int64
+	lastProgress int64 // UnixNano of the last read or completed write
+	pending      int32 // 1 while read data waits to be written
+}
+
+func (d *copyDir) progress() { atomic.StoreInt64(&d.lastProgress, time.Now().UnixNano()) }
+
+func (d *copyDir) stats() CopyStats {
+	return CopyStats{Bytes: atomic.LoadInt64(&d.bytes), Reads: atomic.LoadInt64(&d.reads)}
+}
+
+// instrumentedCopy is like proxyCopy, but counts the traffic in d.
+func instrumentedCopy(errc chan<- error, dst, src net.Conn, d *copyDir) {
+	defer recoverCopy(errc)
+	if wc, ok := src.(*Conn); ok && len(wc.Peeked) > 0 {
+		n, err := dst.Write(wc.Peeked)
+		atomic.AddInt64(&d.bytes, int64(n))
+		if err != nil {
+			errc <- err
+			return
+		}
+		wc.Peeked = nil
+	}
+	src = UnderlyingConn(src)
+	dst = UnderlyingConn(dst)
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.AddInt64(&d.reads, 1)
+			atomic.StoreInt32(&d.pending, 1)
+			d.progress()
+			nw, werr := dst.Write(buf[:n])
+			atomic.AddInt64(&d.bytes, int64(nw))
+			atomic.StoreInt32(&d.pending, 0)
+			d.progress()
+			if werr != nil {
+				errc <- werr
+				return
+			}
+		}
+		if err != nil {
+			errc <- err
+			return
+		}
+	}
+}
+
+// copyInstrumented proxies between src and dst like the two
+// proxyCopy calls in HandleConn, while enforcing dp's StallTimeout
+// and IdleTimeout and reporting to OnCopyDone. Unlike the plain
+// copy, it closes both connections as soon as either direction
+// ends and waits for both copiers, so the reported counts are final.
+func (dp *DialProxy) copyInstrumented(src, dst net.Conn) {
+	start := time.Now()
+	dirs := [2]*copyDir{{dir: FromClient}, {dir: FromServer}}
+	for _, d := range dirs {
+		atomic.StoreInt64(&d.lastProgress, start.UnixNano())
+	}
+
+	errc := make(chan error, 2)
+	go instrumentedCopy(errc, dst, src, dirs[0])
+	go instrumentedCopy(errc, src, dst, dirs[1])
+
+	var (
+		stats    ConnStats
+		stalled  [2]bool
+		tick     <-chan time.Time
+		copyErrs [2]error
+	)
+	if iv := dp.checkInterval(); iv > 0 {
+		t := time.NewTicker(iv)
+		defer t.Stop()
+		tick = t.C
+	}
+loop:
+	for {
+		select {
+		case err := <-errc:
+			// Close both ends so the other copier finishes
+			// and its counts are final.
+			src.Close()
+			dst.Close()
+			copyErrs = [2]error{err, <-errc}
+			break loop
+		case now := <-tick:
+			idle := dp.IdleTimeout > 0
+			for i, d := range dirs {
+				since := now.Sub(time.Unix(0, atomic.LoadInt64(&d.lastProgress)))
+				if idle && since < dp.IdleTimeout {
+					idle = false
+				}
+				if dp.StallTimeout <= 0 {
+					continue
+				}
+				isStalled := atomic.LoadInt32(&d.pending) == 1 && since >= dp.StallTimeout
+				if isStalled && !stalled[i] {
+					stats.Stalls++
+					if dp.OnStall != nil {
+						dp.OnStall(src, d.dir, since)
+					}
+				}
+				stalled[i] = isStalled
+			}
+			if idle {
+				stats.IdleClosed = true
+				src.Close()
+				dst.Close()
+				copyErrs = [2]error{<-errc, <-errc}
+				break loop
+			}
+		}
+	}
+
+	for _, err := range copyErrs {
+		repanic(err)
+	}
+	if dp.OnCopyDone != nil {
+		stats.FromClient = dirs[0].stats()
+		stats.FromServer = dirs[1].stats()
+		stats.Duration = time.Since(start)
+		dp.OnCopyDone(src, stats)
+	}
+}
+
+// checkInterval returns how often copyInstrumented checks for stalls
+// and idleness, or zero if it doesn't need to.
+func (dp *DialProxy) checkInterval() time.Duration {
+	var iv time.Duration
+	for _, d := range []time.Duration{dp.StallTimeout, dp.IdleTimeout} {
+		if d > 0 && (iv == 0 || d < iv) {
+			iv = d
+		}
+	}
+	iv /= 4
+	if iv > 0 && iv < 10*time.Millisecond {
+		iv = 10 * time.Millisecond
+	}
+	return iv
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeDialProxy returns dp's client and backend ends, with dp
+// handling a connection between them.
+func pipeDialProxy(dp *DialProxy, peeked string) (client, backend net.Conn) {
+	backend, dst := net.Pipe()
+	dp.DialContext = func(context.Context, string, string) (net.Conn, error) {
+		return dst, nil
+	}
+	client, src := net.Pipe()
+	go dp.HandleConn(&Conn{Peeked: []byte(peeked), Conn: src})
+	return client, backend
+}
+
+func TestDialProxyCopyStats(t *testing.T) {
+	done := make(chan ConnStats, 1)
+	dp := &DialProxy{OnCopyDone: func(_ net.Conn, st ConnStats) { done <- st }}
+	client, backend := pipeDialProxy(dp, "GET")
+	defer client.Close()
+
+	go io.WriteString(client, " /")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(backend, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "GET /" {
+		t.Fatalf("backend got %q; want %q", buf, "GET /")
+	}
+	go io.WriteString(backend, "ok")
+	if _, err := io.ReadFull(client, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+	backend.Close()
+
+	st := <-done
+	if st.FromClient.Bytes != 5 || st.FromClient.Reads != 1 {
+		t.Errorf("FromClient = %+v; want 5 bytes in 1 read", st.FromClient)
+	}
+	if st.FromServer.Bytes != 2 || st.FromServer.Reads != 1 {
+		t.Errorf("FromServer = %+v; want 2 bytes in 1 read", st.FromServer)
+	}
+	if st.IdleClosed || st.Stalls != 0 {
+		t.Errorf("IdleClosed = %v, Stalls = %d; want false, 0", st.IdleClosed, st.Stalls)
+	}
+}
+
+func TestDialProxyStall(t *testing.T) {
+	stalls := make(chan byte, 2)
+	done := make(chan ConnStats, 1)
+	dp := &DialProxy{
+		StallTimeout: 50 * time.Millisecond,
+		OnStall:      func(_ net.Conn, dir byte, _ time.Duration) { stalls <- dir },
+		OnCopyDone:   func(_ net.Conn, st ConnStats) { done <- st },
+	}
+	client, backend := pipeDialProxy(dp, "")
+
+	// The backend never reads, so the client's bytes are stuck.
+	go io.WriteString(client, "hello")
+	select {
+	case dir := <-stalls:
+		if dir != FromClient {
+			t.Errorf("stalled direction = %q; want %q", dir, FromClient)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for stall")
+	}
+	client.Close()
+	backend.Close()
+	if st := <-done; st.Stalls != 1 {
+		t.Errorf("Stalls = %d; want 1", st.Stalls)
+	}
+}
+
+func TestDialProxyIdleTimeout(t *testing.T) {
+	done := make(chan ConnStats, 1)
+	dp := &DialProxy{
+		IdleTimeout: 50 * time.Millisecond,
+		OnCopyDone:  func(_ net.Conn, st ConnStats) { done <- st },
+	}
+	client, backend := pipeDialProxy(dp, "")
+	defer backend.Close()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read error = %v; want EOF from idle close", err)
+	}
+	if st := <-done; !st.IdleClosed {
+		t.Error("IdleClosed = false; want true")
+	}
+}
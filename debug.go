@@ -0,0 +1,134 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// debugVars returns the value of the "tcpproxy" variable served on
+// /debug/vars.
+func (p *Proxy) debugVars() interface{} {
+	p.mu.Lock()
+	routes := make(map[string]int, len(p.configs))
+	configs := make(map[string]*config, len(p.configs))
+	for ipPort, cfg := range p.configs {
+		configs[ipPort] = cfg
+	}
+	p.mu.Unlock()
+	total := 0
+	for ipPort, cfg := range configs {
+		routes[ipPort] = len(cfg.Routes())
+		total += routes[ipPort]
+	}
+
+	namespaces := make(map[string]NamespaceStats)
+	for _, ns := range p.namespaceList() {
+		namespaces[ns.Name()] = ns.Stats()
+	}
+	vars := map[string]interface{}{
+		"activeConns": atomic.LoadInt64(&p.activeConns),
+		"routes":      routes,
+		"routesTotal": total,
+		"namespaces":  namespaces,
+		"misses":      p.MissCounts(),
+		"panics":      p.Panics(),
+	}
+	if p.ScanGuard != nil {
+		vars["bannedClients"] = len(p.ScanGuard.Banned())
+	}
+	return vars
+}
+
+// serveVars serves the same memstats and cmdline variables as
+// expvar.Handler, plus p's own variables. The expvar package isn't
+// imported because its init registers /debug/vars on
+// http.DefaultServeMux, which would publish them to anything serving
+// that mux.
+func (p *Proxy) serveVars(w http.ResponseWriter, r *http.Request) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	writeJSON(w, map[string]interface{}{
+		"cmdline":  os.Args,
+		"memstats": &ms,
+		"tcpproxy": p.debugVars(),
+	})
+}
+
+// servePprof serves runtime/pprof profiles under /debug/pprof/,
+// compatibly with net/http/pprof. That package isn't imported
+// because it registers its handlers on http.DefaultServeMux.
+func servePprof(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	switch name {
+	case "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, prof := range pprof.Profiles() {
+			fmt.Fprintf(w, "%d\t%s\n", prof.Count(), prof.Name())
+		}
+		fmt.Fprintf(w, "-\tprofile\n")
+		return
+	case "profile":
+		serveCPUProfile(w, r)
+		return
+	}
+
+	prof := pprof.Lookup(name)
+	if prof == nil {
+		http.Error(w, "unknown profile", http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if debug != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	if name == "heap" && r.FormValue("gc") != "" {
+		runtime.GC()
+	}
+	prof.WriteTo(w, debug)
+}
+
+// serveCPUProfile records a CPU profile for the number of seconds in
+// the "seconds" parameter, 30 by default.
+func serveCPUProfile(w http.ResponseWriter, r *http.Request) {
+	secs, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || secs <= 0 {
+		secs = 30
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// Most likely another profile is already running.
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "could not enable CPU profiling: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-time.After(time.Duration(secs) * time.Second):
+	case <-r.Context().Done():
+	}
+	pprof.StopCPUProfile()
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminDebug(t *testing.T) {
+	p := &Proxy{
+		AdminDebug: true,
+		AdminAuth: &AdminAuth{Tokens: map[string]AdminGrant{
+			"reader": {Read: true},
+			"oncall": {Debug: true},
+		}},
+	}
+	p.AddSNIRoute(testFrontAddr, "foo.com", noopTarget{})
+	p.AddRoute(testFrontAddr, noopTarget{})
+	h := p.AdminHandler()
+	get := func(url, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/debug/vars", "reader"); rec.Code != http.StatusForbidden {
+		t.Errorf("/debug/vars with a Read grant = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec := get("/debug/vars", "oncall")
+	var vars struct {
+		Cmdline  []string
+		Memstats map[string]interface{}
+		Tcpproxy struct {
+			ActiveConns int64
+			Routes      map[string]int
+			RoutesTotal int
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("decoding /debug/vars: %v\n%s", err, rec.Body)
+	}
+	if vars.Memstats == nil {
+		t.Error("/debug/vars is missing memstats")
+	}
+	if len(vars.Cmdline) == 0 {
+		t.Error("/debug/vars is missing cmdline")
+	}
+	if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest("GET", "/debug/vars", nil)); pattern != "" {
+		t.Errorf("http.DefaultServeMux serves /debug/vars with pattern %q", pattern)
+	}
+	// The SNI route comes with an ACME route.
+	if vars.Tcpproxy.RoutesTotal != 3 || vars.Tcpproxy.Routes[testFrontAddr] != 3 {
+		t.Errorf("tcpproxy vars = %+v; want 3 routes", vars.Tcpproxy)
+	}
+
+	rec = get("/debug/pprof/", "oncall")
+	if !strings.Contains(rec.Body.String(), "goroutine") {
+		t.Errorf("/debug/pprof/ index = %q; want it to list goroutine", rec.Body)
+	}
+	rec = get("/debug/pprof/goroutine?debug=1", "oncall")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine profile") {
+		t.Errorf("/debug/pprof/goroutine = %d %q", rec.Code, rec.Body)
+	}
+
+	p.AdminDebug = false
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/debug/vars", nil)
+	req.Header.Set("Authorization", "Bearer oncall")
+	p.AdminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("/debug/vars without AdminDebug = %d; want %d", rec.Code, http.StatusNotFound)
+	}
+}
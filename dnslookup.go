@@ -0,0 +1,106 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNSLookup routes connections to wherever DNS says their SNI or Host
+// name lives. Its Lookup method is a TargetLookup, for use with
+// AddSNIDynamicRoute and AddHTTPDynamicRoute:
+//
+//	lookup := &tcpproxy.DNSLookup{
+//		Suffixes: map[string]string{"example.com": "internal.example.net"},
+//	}
+//	p.AddSNIDynamicRoute(":443", lookup.Lookup)
+//
+// routes foo.example.com to the address foo.internal.example.net
+// resolves to, on port 443.
+type DNSLookup struct {
+	// Suffixes maps the name suffixes that may be routed to the
+	// suffixes they are rewritten to before resolving. A suffix
+	// matches names below it but not the name itself, so
+	// "example.com" matches "foo.example.com" but neither
+	// "example.com" nor "badexample.com". If several suffixes
+	// match, the longest wins. An empty replacement resolves the
+	// name unchanged.
+	//
+	// Names that match no suffix are rejected, so that clients
+	// can't make the proxy connect to arbitrary hosts.
+	Suffixes map[string]string
+
+	// Port is the port to connect to.
+	// If empty, "443" is used.
+	Port string
+
+	// Resolver optionally specifies the resolver to use, which
+	// also controls how long answers are cached.
+	// If nil, a Resolver with default settings is used.
+	Resolver *Resolver
+}
+
+// Lookup implements TargetLookup. It returns an ip:port address for
+// hostname, or an error if hostname is not under an allowed suffix
+// or cannot be resolved.
+func (l *DNSLookup) Lookup(ctx context.Context, hostname string) (string, error) {
+	name, err := l.internalName(hostname)
+	if err != nil {
+		return "", err
+	}
+	r := l.Resolver
+	if r == nil {
+		r = defaultResolver
+	}
+	addrs, err := r.LookupHost(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addrs[0], l.port()), nil
+}
+
+// internalName returns the name to resolve for hostname, applying
+// the longest matching suffix mapping.
+func (l *DNSLookup) internalName(hostname string) (string, error) {
+	hostname = CanonicalName(hostname)
+	best := -1
+	var name string
+	for suffix, repl := range l.Suffixes {
+		suffix = CanonicalName(strings.TrimPrefix(suffix, "."))
+		prefix := strings.TrimSuffix(hostname, "."+suffix)
+		if prefix == hostname || prefix == "" || len(suffix) <= best {
+			continue
+		}
+		best = len(suffix)
+		name = hostname
+		if repl = strings.Trim(repl, "."); repl != "" {
+			name = prefix + "." + repl
+		}
+	}
+	if best < 0 {
+		return "", fmt.Errorf("tcpproxy: %q is not under an allowed suffix", hostname)
+	}
+	return name, nil
+}
+
+func (l *DNSLookup) port() string {
+	if l.Port != "" {
+		return l.Port
+	}
+	return "443"
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDNSLookup(t *testing.T) {
+	var lookups []string
+	l := &DNSLookup{
+		Suffixes: map[string]string{
+			"example.com":       "internal.example.net",
+			"db.example.com":    "db.internal",
+			".public.test":      "",
+			"other.example.org": "",
+		},
+		Resolver: &Resolver{CacheTTL: -1, lookupHost: func(_ context.Context, host string) ([]string, error) {
+			lookups = append(lookups, host)
+			return []string{"10.0.0.1", "10.0.0.2"}, nil
+		}},
+	}
+	tests := []struct {
+		host    string
+		want    string // looked up name, or "" for a rejected host
+		wantErr bool
+	}{
+		{"foo.example.com", "foo.internal.example.net", false},
+		{"Bar.Example.COM.", "bar.internal.example.net", false},
+		{"a.db.example.com", "a.db.internal", false},
+		{"www.public.test", "www.public.test", false},
+		{"example.com", "", true},
+		{"badexample.com", "", true},
+		{"evil.com", "", true},
+	}
+	for _, tt := range tests {
+		lookups = nil
+		got, err := l.Lookup(context.Background(), tt.host)
+		if tt.wantErr {
+			if err == nil || len(lookups) > 0 {
+				t.Errorf("Lookup(%q) = %q, looked up %q; want error without lookup", tt.host, got, lookups)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Lookup(%q): %v", tt.host, err)
+			continue
+		}
+		if got != "10.0.0.1:443" || len(lookups) != 1 || lookups[0] != tt.want {
+			t.Errorf("Lookup(%q) = %q, looked up %q; want 10.0.0.1:443 via %q", tt.host, got, lookups, tt.want)
+		}
+	}
+}
+
+func TestDNSLookupCache(t *testing.T) {
+	n := 0
+	l := &DNSLookup{
+		Suffixes: map[string]string{"example.com": ""},
+		Port:     "8443",
+		Resolver: &Resolver{lookupHost: func(context.Context, string) ([]string, error) {
+			n++
+			return []string{"2001:db8::1"}, nil
+		}},
+	}
+	for i := 0; i < 3; i++ {
+		got, err := l.Lookup(context.Background(), "foo.example.com")
+		if err != nil || got != "[2001:db8::1]:8443" {
+			t.Fatalf("Lookup = %q, %v; want [2001:db8::1]:8443", got, err)
+		}
+	}
+	if n != 1 {
+		t.Errorf("resolved %d times; want 1", n)
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A ConfigDump is a snapshot of a Proxy's runtime configuration,
+// suitable for serializing and diffing against the intended
+// configuration. See Proxy.DumpConfig.
+type ConfigDump struct {
+	AdminAddr        string `json:"adminAddr,omitempty"`
+	PreDial          bool   `json:"preDial"`
+	FastOpenQueueLen int    `json:"fastOpenQueueLen,omitempty"`
+	DeferAccept      string `json:"deferAccept,omitempty"`
+	InterfaceRefresh string `json:"interfaceRefresh,omitempty"`
+	IPFamily         string `json:"ipFamily,omitempty"`
+	RawNames         bool   `json:"rawNames,omitempty"`
+	AuditSize        int    `json:"auditSize,omitempty"`
+	MaxSniffSize     int    `json:"maxSniffSize,omitempty"`
+	SniffTimeout     string `json:"sniffTimeout,omitempty"`
+
+	Resolver  *ResolverDump  `json:"resolver,omitempty"`
+	ScanGuard *ScanGuardDump `json:"scanGuard,omitempty"`
+
+	// Listeners are sorted by address.
+	Listeners []ListenerDump `json:"listeners"`
+
+	// Namespaces are sorted by name.
+	Namespaces []NamespaceDump `json:"namespaces,omitempty"`
+}
+
+// A ResolverDump describes a Resolver.
+type ResolverDump struct {
+	Static   map[string][]string `json:"static,omitempty"`
+	Servers  []string            `json:"servers,omitempty"`
+	CacheTTL string              `json:"cacheTTL,omitempty"`
+}
+
+// A ScanGuardDump describes a Proxy's ScanGuard.
+type ScanGuardDump struct {
+	Threshold   int    `json:"threshold,omitempty"`
+	Window      string `json:"window,omitempty"`
+	BanDuration string `json:"banDuration,omitempty"`
+	LogInterval string `json:"logInterval,omitempty"`
+}
+
+// A NamespaceDump describes a Namespace of a ConfigDump.
+type NamespaceDump struct {
+	Name  string         `json:"name"`
+	Quota NamespaceQuota `json:"quota"`
+	Scope NamespaceScope `json:"scope"`
+	Stats NamespaceStats `json:"stats"`
+}
+
+// A ListenerDump describes one listener of a ConfigDump.
+type ListenerDump struct {
+	Addr string `json:"addr"`
+
+	// SharesRoutesWith lists the other listeners using the same
+	// route table; see ShareRoutes.
+	SharesRoutesWith []string `json:"sharesRoutesWith,omitempty"`
+
+	// Resolved lists the concrete addresses currently being
+	// listened on, for templated listener addresses.
+	Resolved []string `json:"resolved,omitempty"`
+
+	StopACME      bool        `json:"stopACME,omitempty"`
+	BannerWait    string      `json:"bannerWait,omitempty"`
+	DefaultTarget *TargetDump `json:"defaultTarget,omitempty"`
+	Routes        []RouteDump `json:"routes"`
+}
+
+// A RouteDump describes one route of a ListenerDump, in match order.
+type RouteDump struct {
+	Id   uuid.UUID `json:"id"`
+	Kind string    `json:"kind"`
+
+	// Match is the exact SNI or Host name the route matches, if it
+	// was added with AddSNIRoute or AddHTTPHostRoute.
+	Match string `json:"match,omitempty"`
+
+	Target    *TargetDump `json:"target,omitempty"`
+	Observed  bool        `json:"observed,omitempty"`
+	Namespace string      `json:"namespace,omitempty"`
+}
+
+// A TargetDump describes a Target. Fields that don't apply to the
+// target's type are left empty.
+type TargetDump struct {
+	Type string `json:"type"`
+	Addr string `json:"addr,omitempty"`
+
+	ProxyProtocolVersion int           `json:"proxyProtocolVersion,omitempty"`
+	WarmConns            int           `json:"warmConns,omitempty"`
+	ForwardedHeaders     bool          `json:"forwardedHeaders,omitempty"`
+	PortOffset           int           `json:"portOffset,omitempty"`
+	PortFunc             bool          `json:"portFunc,omitempty"`
+	IdleTimeout          string        `json:"idleTimeout,omitempty"`
+	StallTimeout         string        `json:"stallTimeout,omitempty"`
+	Resolver             *ResolverDump `json:"resolver,omitempty"`
+
+	// Wraps is the target wrapped by a FaultTarget or RecordTarget.
+	Wraps *TargetDump `json:"wraps,omitempty"`
+
+	// Members are the members of a TargetGroup.
+	Members   []GroupMemberDump `json:"members,omitempty"`
+	SlowStart string            `json:"slowStart,omitempty"`
+
+	// Schedule, During and Otherwise describe a ScheduledTarget.
+	Schedule  string      `json:"schedule,omitempty"`
+	During    *TargetDump `json:"during,omitempty"`
+	Otherwise *TargetDump `json:"otherwise,omitempty"`
+}
+
+// A GroupMemberDump describes a member of a TargetGroup.
+type GroupMemberDump struct {
+	Id       uuid.UUID   `json:"id"`
+	Weight   int         `json:"weight"`
+	Draining bool        `json:"draining,omitempty"`
+	Target   *TargetDump `json:"target"`
+}
+
+// DumpConfig returns a snapshot of p's listeners, routes, targets and
+// options.
+func (p *Proxy) DumpConfig() *ConfigDump {
+	d := &ConfigDump{
+		AdminAddr:        p.AdminAddr,
+		PreDial:          p.PreDial,
+		FastOpenQueueLen: p.FastOpenQueueLen,
+		RawNames:         p.RawNames,
+		AuditSize:        p.AuditSize,
+		MaxSniffSize:     p.MaxSniffSize,
+		Resolver:         dumpResolver(p.Resolver),
+	}
+	if p.IPFamily != IPFamilyDefault {
+		d.IPFamily = p.IPFamily.String()
+	}
+	if p.SniffTimeout > 0 {
+		d.SniffTimeout = p.SniffTimeout.String()
+	}
+	if sg := p.ScanGuard; sg != nil {
+		d.ScanGuard = &ScanGuardDump{
+			Threshold:   sg.Threshold,
+			Window:      durationString(sg.Window),
+			BanDuration: durationString(sg.BanDuration),
+			LogInterval: durationString(sg.LogInterval),
+		}
+	}
+	if p.DeferAccept > 0 {
+		d.DeferAccept = p.DeferAccept.String()
+	}
+	if p.InterfaceRefresh > 0 {
+		d.InterfaceRefresh = p.InterfaceRefresh.String()
+	}
+
+	p.mu.Lock()
+	addrs := make([]string, 0, len(p.configs))
+	for ipPort := range p.configs {
+		addrs = append(addrs, ipPort)
+	}
+	sort.Strings(addrs)
+	configs := make(map[string]*config, len(p.configs))
+	resolved := make(map[string][]string)
+	for _, ipPort := range addrs {
+		configs[ipPort] = p.configs[ipPort]
+		for addr := range p.templated[ipPort] {
+			resolved[ipPort] = append(resolved[ipPort], addr)
+		}
+		sort.Strings(resolved[ipPort])
+	}
+	p.mu.Unlock()
+
+	for _, ipPort := range addrs {
+		cfg := configs[ipPort]
+		ld := ListenerDump{
+			Addr:          ipPort,
+			Resolved:      resolved[ipPort],
+			StopACME:      cfg.stopACME,
+			DefaultTarget: dumpTarget(cfg.defaultTarget),
+			Routes:        []RouteDump{},
+		}
+		if cfg.bannerWait > 0 {
+			ld.BannerWait = cfg.bannerWait.String()
+		}
+		for _, other := range addrs {
+			if other != ipPort && configs[other] == cfg {
+				ld.SharesRoutesWith = append(ld.SharesRoutesWith, other)
+			}
+		}
+		for _, r := range cfg.Routes() {
+			cfg.mu.Lock()
+			var name string
+			switch r.Route.(type) {
+			case sniMatch, httpHostMatch:
+				// The ACME route added alongside an SNI route
+				// shares its id, but not its name.
+				name = cfg.routeNames[r.Id]
+			}
+			observed := cfg.observers[r.Id] != nil
+			cfg.mu.Unlock()
+			ld.Routes = append(ld.Routes, RouteDump{
+				Id:        r.Id,
+				Kind:      describeRoute(r.Route),
+				Match:     name,
+				Target:    dumpTarget(routeTarget(r.Route)),
+				Observed:  observed,
+				Namespace: p.routeNamespace(r.Id),
+			})
+		}
+		d.Listeners = append(d.Listeners, ld)
+	}
+	for _, ns := range p.namespaceList() {
+		d.Namespaces = append(d.Namespaces, NamespaceDump{
+			Name:  ns.Name(),
+			Quota: ns.Quota(),
+			Scope: ns.Scope(),
+			Stats: ns.Stats(),
+		})
+	}
+	return d
+}
+
+// routeTarget returns the fixed target of r, or nil if r picks its
+// target dynamically.
+func routeTarget(r route) Target {
+	switch r := r.(type) {
+	case fixedTarget:
+		return r.t
+	case sniMatch:
+		return r.target
+	case httpHostMatch:
+		return r.target
+	case protocolMatch:
+		return r.target
+	case peekMatch:
+		return r.target
+	}
+	return nil
+}
+
+func dumpTarget(t Target) *TargetDump {
+	if t == nil {
+		return nil
+	}
+	if nt, ok := t.(*namespaceTarget); ok {
+		t = nt.Target
+	}
+	td := &TargetDump{Type: fmt.Sprintf("%T", t)}
+	switch t := t.(type) {
+	case *DialProxy:
+		td.Addr = t.Addr
+		td.ProxyProtocolVersion = t.ProxyProtocolVersion
+		td.WarmConns = t.WarmConns
+		td.ForwardedHeaders = t.ForwardedHeaders
+		td.PortOffset = t.PortOffset
+		td.PortFunc = t.PortFunc != nil
+		td.IdleTimeout = durationString(t.IdleTimeout)
+		td.StallTimeout = durationString(t.StallTimeout)
+		td.Resolver = dumpResolver(t.Resolver)
+	case *TargetListener:
+		td.Addr = t.Address
+	case *FaultTarget:
+		td.Wraps = dumpTarget(t.Target)
+	case *RecordTarget:
+		td.Wraps = dumpTarget(t.Target)
+	case *TargetGroup:
+		td.SlowStart = durationString(t.SlowStart)
+		for _, m := range t.Members() {
+			td.Members = append(td.Members, GroupMemberDump{
+				Id:       m.Id,
+				Weight:   m.Weight,
+				Draining: m.Draining,
+				Target:   dumpTarget(m.Target),
+			})
+		}
+	case *ScheduledTarget:
+		if t.Schedule != nil {
+			td.Schedule = t.Schedule.String()
+		}
+		td.During = dumpTarget(t.During)
+		td.Otherwise = dumpTarget(t.Otherwise)
+	}
+	return td
+}
+
+func dumpResolver(r *Resolver) *ResolverDump {
+	if r == nil {
+		return nil
+	}
+	return &ResolverDump{
+		Static:   r.Static,
+		Servers:  r.Servers,
+		CacheTTL: durationString(r.CacheTTL),
+	}
+}
+
+// durationString formats d for a dump, or returns "" if d is zero.
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
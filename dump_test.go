@@ -0,0 +1,125 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProxyDumpConfig(t *testing.T) {
+	p := &Proxy{PreDial: true, DeferAccept: 2 * time.Second}
+	sniId := p.AddSNIRoute(":443", "foo.com", &DialProxy{Addr: "10.0.0.1:443", ProxyProtocolVersion: 1})
+	fixedId := p.AddRoute(":443", &FaultTarget{Target: To("10.0.0.2:443")})
+	if err := p.ShareRoutes("unix:/run/front.sock", ":443"); err != nil {
+		t.Fatal(err)
+	}
+	p.SetDefaultTarget(":80", To("10.0.0.3:80"))
+
+	d := p.DumpConfig()
+	if !d.PreDial || d.DeferAccept != "2s" {
+		t.Errorf("got PreDial %v DeferAccept %q", d.PreDial, d.DeferAccept)
+	}
+
+	var addrs []string
+	for _, l := range d.Listeners {
+		addrs = append(addrs, l.Addr)
+	}
+	if want := []string{":443", ":80", "unix:/run/front.sock"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("listeners = %q; want %q", addrs, want)
+	}
+
+	l := d.Listeners[0]
+	if want := []string{"unix:/run/front.sock"}; !reflect.DeepEqual(l.SharesRoutesWith, want) {
+		t.Errorf("SharesRoutesWith = %q; want %q", l.SharesRoutesWith, want)
+	}
+	want := []RouteDump{
+		{Id: sniId, Kind: "ACME tls-sni-01 challenge"},
+		{Id: sniId, Kind: "TLS SNI matcher", Match: "foo.com", Target: &TargetDump{
+			Type: "*tcpproxy.DialProxy", Addr: "10.0.0.1:443", ProxyProtocolVersion: 1,
+		}},
+		{Id: fixedId, Kind: "always", Target: &TargetDump{
+			Type:  "*tcpproxy.FaultTarget",
+			Wraps: &TargetDump{Type: "*tcpproxy.DialProxy", Addr: "10.0.0.2:443"},
+		}},
+	}
+	if !reflect.DeepEqual(l.Routes, want) {
+		got, _ := json.Marshal(l.Routes)
+		t.Errorf("routes = %s", got)
+	}
+
+	if dt := d.Listeners[1].DefaultTarget; dt == nil || dt.Addr != "10.0.0.3:80" {
+		t.Errorf("default target = %+v", dt)
+	}
+	if _, err := json.Marshal(d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyDumpConfigOptions(t *testing.T) {
+	r := &Resolver{Servers: []string{"192.0.2.53"}, CacheTTL: -1}
+	p := &Proxy{
+		IPFamily:     IPv6Only,
+		RawNames:     true,
+		AuditSize:    100,
+		MaxSniffSize: 8192,
+		SniffTimeout: 5 * time.Second,
+		Resolver:     r,
+		ScanGuard:    &ScanGuard{Threshold: 3, Window: time.Minute},
+	}
+	sched, err := ParseSchedule("sat,sun 02:00-04:00", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := new(TargetGroup)
+	memberId := g.Add(To("10.0.0.1:443"), 2)
+	p.AddRoute(":443", &ScheduledTarget{
+		Schedule: sched,
+		During:   To("10.0.0.9:443"),
+		Otherwise: &DialProxy{
+			Addr:        "10.0.0.2:443",
+			IdleTimeout: time.Hour,
+			PortFunc:    func(net.Conn, int) int { return 8443 },
+		},
+	})
+	p.AddRoute(":80", g)
+
+	d := p.DumpConfig()
+	if d.IPFamily != "ipv6-only" || !d.RawNames || d.AuditSize != 100 || d.MaxSniffSize != 8192 || d.SniffTimeout != "5s" {
+		t.Errorf("options = %+v", d)
+	}
+	if d.Resolver == nil || !reflect.DeepEqual(d.Resolver.Servers, r.Servers) || d.Resolver.CacheTTL != "-1ns" {
+		t.Errorf("resolver = %+v", d.Resolver)
+	}
+	if d.ScanGuard == nil || d.ScanGuard.Threshold != 3 || d.ScanGuard.Window != "1m0s" {
+		t.Errorf("scan guard = %+v", d.ScanGuard)
+	}
+
+	st := d.Listeners[0].Routes[0].Target
+	if st.Schedule != "sat,sun 02:00-04:00 UTC" || st.During.Addr != "10.0.0.9:443" {
+		t.Errorf("scheduled target = %+v", st)
+	}
+	if o := st.Otherwise; o == nil || !o.PortFunc || o.IdleTimeout != "1h0m0s" {
+		t.Errorf("scheduled target otherwise = %+v", o)
+	}
+	gt := d.Listeners[1].Routes[0].Target
+	want := []GroupMemberDump{{Id: memberId, Weight: 2, Target: &TargetDump{Type: "*tcpproxy.DialProxy", Addr: "10.0.0.1:443"}}}
+	if !reflect.DeepEqual(gt.Members, want) {
+		t.Errorf("group members = %+v", gt.Members)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// An Explanation describes how a listener's routes would handle a
+// connection for a hostname. See Proxy.Explain.
+type Explanation struct {
+	Listener string `json:"listener"`
+	HostName string `json:"hostName"`
+
+	// Steps are the routes evaluated, in order, up to and including
+	// the one that matched.
+	Steps []ExplainStep `json:"steps"`
+
+	// Matched reports whether a route (or the listener's default
+	// target) would handle the connection. If false, the
+	// connection would be closed.
+	Matched bool      `json:"matched"`
+	RouteId uuid.UUID `json:"routeId"` // uuid.Nil for the default target
+	Target  string    `json:"target,omitempty"`
+	Reason  string    `json:"reason"`
+}
+
+// An ExplainStep is the result of evaluating one route.
+type ExplainStep struct {
+	RouteId uuid.UUID `json:"routeId"`
+	Route   string    `json:"route"`
+	Matched bool      `json:"matched"`
+
+	// Input is the kind of synthetic connection the route matched,
+	// "TLS" or "HTTP", if any.
+	Input  string `json:"input,omitempty"`
+	Target string `json:"target,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// Explain evaluates the routes of the ipPort listener for hostName
+// without a real connection, and reports which route would win and
+// why. Each route is tried against a synthetic TLS ClientHello with
+// hostName as the SNI, then against an HTTP/1.1 request with hostName
+// as the Host header.
+//
+// Matchers and dynamic lookups are run for real, so lookups with
+// side effects will see the call. ACME challenge routes are not
+// evaluated, since that would probe the backends.
+func (p *Proxy) Explain(ipPort, hostName string) (*Explanation, error) {
+	p.mu.Lock()
+	cfg := p.configs[ipPort]
+	p.mu.Unlock()
+	if cfg == nil {
+		return nil, fmt.Errorf("tcpproxy: no listener %q", ipPort)
+	}
+
+	inputs := []struct {
+		name string
+		data []byte
+	}{
+		{"TLS", syntheticClientHello(hostName)},
+		{"HTTP", []byte("GET / HTTP/1.1\r\nHost: " + hostName + "\r\n\r\n")},
+	}
+
+	ctx := p.matchContext()
+	ex := &Explanation{Listener: ipPort, HostName: hostName}
+	for _, r := range cfg.Routes() {
+		step := ExplainStep{RouteId: r.Id, Route: describeRoute(r.Route)}
+		if _, ok := r.Route.(*acmeMatch); ok {
+			step.Note = "ACME challenge routes are not evaluated"
+			ex.Steps = append(ex.Steps, step)
+			continue
+		}
+		for _, in := range inputs {
+			br := bufio.NewReader(bytes.NewReader(in.data))
+			if target, _ := r.Route.match(ctx, br); target != nil {
+				step.Matched = true
+				step.Input = in.name
+				step.Target = describeTarget(target)
+				break
+			}
+		}
+		ex.Steps = append(ex.Steps, step)
+		if step.Matched {
+			ex.Matched = true
+			ex.RouteId = r.Id
+			ex.Target = step.Target
+			ex.Reason = fmt.Sprintf("route %d (%s) matched the %s input", len(ex.Steps), step.Route, step.Input)
+			return ex, nil
+		}
+	}
+
+	if cfg.defaultTarget != nil {
+		ex.Matched = true
+		ex.Target = describeTarget(cfg.defaultTarget)
+		ex.Reason = "no route matched; the listener's default target is used"
+		return ex, nil
+	}
+	ex.Reason = "no route matched and the listener has no default target; the connection is closed"
+	return ex, nil
+}
+
+// describeRoute returns a short human-readable description of r.
+func describeRoute(r route) string {
+	switch r := r.(type) {
+	case fixedTarget:
+		return "always"
+	case sniMatch:
+		return "TLS SNI matcher"
+	case dynamicSNIMatch:
+		return "dynamic lookup"
+	case httpHostMatch:
+		return "HTTP Host matcher"
+	case *acmeMatch:
+		return "ACME tls-sni-01 challenge"
+	case protocolMatch:
+		return "protocol " + r.proto.String()
+	case peekMatch:
+		if r.prefix != nil {
+			return fmt.Sprintf("prefix %q", r.prefix)
+		}
+		return "peek matcher"
+	}
+	return fmt.Sprintf("%T", r)
+}
+
+// describeTarget returns a short human-readable description of t.
+func describeTarget(t Target) string {
+	if nt, ok := t.(*namespaceTarget); ok {
+		t = nt.Target
+	}
+	switch t := t.(type) {
+	case *DialProxy:
+		return "dial " + t.Addr
+	case *TargetListener:
+		return "listener " + t.Address
+	}
+	return fmt.Sprintf("%T", t)
+}
+
+// syntheticClientHello returns the first TLS record a client would
+// send when connecting with serverName as the SNI.
+func syntheticClientHello(serverName string) []byte {
+	rec := new(helloRecorder)
+	tls.Client(rec, &tls.Config{
+		ServerName: strings.TrimSuffix(serverName, "."),
+	}).Handshake()
+	return rec.buf.Bytes()
+}
+
+// helloRecorder is a net.Conn that records writes and fails reads,
+// so a TLS client handshake stops after sending its ClientHello.
+type helloRecorder struct {
+	buf      bytes.Buffer
+	net.Conn // nil; crash on any unexpected use
+}
+
+func (c *helloRecorder) Write(p []byte) (int, error) { return c.buf.Write(p) }
+func (c *helloRecorder) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (c *helloRecorder) Close() error                { return nil }
@@ -0,0 +1,101 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestProxyExplain(t *testing.T) {
+	var p Proxy
+	httpId := p.AddHTTPHostRoute(testFrontAddr, "foo.com", To("10.0.0.1:80"))
+	sniId := p.AddSNIRoute(testFrontAddr, "bar.com", To("10.0.0.2:443"))
+	fallbackId := p.AddRoute(testFrontAddr, To("10.0.0.3:443"))
+
+	tests := []struct {
+		name      string
+		wantRoute uuid.UUID
+		wantInput string
+		wantSteps int
+		wantDest  string
+	}{
+		{"foo.com", httpId, "HTTP", 1, "dial 10.0.0.1:80"},
+		// The ACME and SNI routes share an id.
+		{"bar.com", sniId, "TLS", 3, "dial 10.0.0.2:443"},
+		{"baz.com", fallbackId, "TLS", 4, "dial 10.0.0.3:443"},
+	}
+	for _, tt := range tests {
+		ex, err := p.Explain(testFrontAddr, tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ex.Matched || ex.RouteId != tt.wantRoute || ex.Target != tt.wantDest {
+			t.Errorf("Explain(%q) = matched %v route %v target %q; want route %v target %q",
+				tt.name, ex.Matched, ex.RouteId, ex.Target, tt.wantRoute, tt.wantDest)
+		}
+		if len(ex.Steps) != tt.wantSteps {
+			t.Errorf("Explain(%q) evaluated %d routes; want %d", tt.name, len(ex.Steps), tt.wantSteps)
+			continue
+		}
+		if last := ex.Steps[len(ex.Steps)-1]; last.Input != tt.wantInput {
+			t.Errorf("Explain(%q) matched on %q input; want %q", tt.name, last.Input, tt.wantInput)
+		}
+	}
+
+	if _, err := p.Explain("5.6.7.8:9", "foo.com"); err == nil {
+		t.Error("Explain on unknown listener succeeded")
+	}
+}
+
+func TestProxyExplainNoMatch(t *testing.T) {
+	var p Proxy
+	p.AddSNIRoute(testFrontAddr, "bar.com", To("10.0.0.2:443"))
+	ex, err := p.Explain(testFrontAddr, "foo.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Matched {
+		t.Fatalf("Explain matched %v; want no match", ex.RouteId)
+	}
+}
+
+func TestAdminExplain(t *testing.T) {
+	var p Proxy
+	id := p.AddSNIRoute(testFrontAddr, "bar.com", To("10.0.0.2:443"))
+
+	srv := httptest.NewServer(p.AdminHandler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/explain?listener=" + testFrontAddr + "&name=bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %s", res.Status)
+	}
+	var ex Explanation
+	if err := json.NewDecoder(res.Body).Decode(&ex); err != nil {
+		t.Fatal(err)
+	}
+	if ex.RouteId != id {
+		t.Fatalf("got route %v; want %v", ex.RouteId, id)
+	}
+}
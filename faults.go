@@ -0,0 +1,157 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// errInjectedReset is returned by reads and writes on a connection
+// that a FaultTarget decided to reset.
+var errInjectedReset = errors.New("tcpproxy: injected connection reset")
+
+// FaultTarget implements Target by wrapping another Target and
+// injecting network faults into the connections handed to it. It is
+// meant for chaos testing the services behind a proxy.
+//
+// Faults apply to bytes read from and written to the client after
+// route matching; bytes peeked while matching are passed through
+// untouched.
+type FaultTarget struct {
+	// Target receives the faulty connections.
+	Target Target
+
+	// SampleRate is the fraction of connections, between 0 and 1,
+	// that faults are injected into. Unsampled connections are
+	// passed to Target unmodified.
+	// If zero, all connections are sampled.
+	SampleRate float64
+
+	// Latency optionally delays every read and write.
+	Latency time.Duration
+
+	// BytesPerSecond optionally caps the throughput of each
+	// direction of the connection.
+	// If zero, throughput is not limited.
+	BytesPerSecond int
+
+	// ResetRate is the probability, between 0 and 1, that any given
+	// read or write resets the connection instead of completing.
+	ResetRate float64
+
+	// CorruptRate is the probability, between 0 and 1, that any
+	// given byte is corrupted in transit.
+	CorruptRate float64
+}
+
+// HandleConn implements the Target interface.
+func (ft *FaultTarget) HandleConn(c net.Conn) {
+	if ft.SampleRate > 0 && rand.Float64() >= ft.SampleRate {
+		ft.Target.HandleConn(c)
+		return
+	}
+	if wc, ok := c.(*Conn); ok {
+		wc.Conn = &faultConn{ft: ft, Conn: wc.Conn}
+		ft.Target.HandleConn(wc)
+		return
+	}
+	ft.Target.HandleConn(&faultConn{ft: ft, Conn: c})
+}
+
+// faultConn is a net.Conn that injects the faults described by ft.
+type faultConn struct {
+	ft *FaultTarget
+	net.Conn
+}
+
+func (c *faultConn) netConn() net.Conn { return c.Conn }
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	if err := c.before(); err != nil {
+		return 0, err
+	}
+	if lim := c.ft.BytesPerSecond; lim > 0 && len(p) > lim {
+		p = p[:lim]
+	}
+	n, err := c.Conn.Read(p)
+	c.corrupt(p[:n])
+	c.throttle(n)
+	return n, err
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if err := c.before(); err != nil {
+			return written, err
+		}
+		chunk := p
+		if lim := c.ft.BytesPerSecond; lim > 0 && len(chunk) > lim {
+			chunk = chunk[:lim]
+		}
+		if c.ft.CorruptRate > 0 {
+			// Don't scribble on the caller's buffer.
+			chunk = append([]byte(nil), chunk...)
+			c.corrupt(chunk)
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		c.throttle(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// before applies the per-call latency and reset faults.
+func (c *faultConn) before() error {
+	if c.ft.Latency > 0 {
+		time.Sleep(c.ft.Latency)
+	}
+	if c.ft.ResetRate > 0 && rand.Float64() < c.ft.ResetRate {
+		if tc, ok := tcpConn(c.Conn); ok {
+			// Discard unsent data and send a RST on close.
+			tc.SetLinger(0)
+		}
+		c.Conn.Close()
+		return errInjectedReset
+	}
+	return nil
+}
+
+// corrupt flips the bits of randomly chosen bytes of p.
+func (c *faultConn) corrupt(p []byte) {
+	if c.ft.CorruptRate <= 0 {
+		return
+	}
+	for i := range p {
+		if rand.Float64() < c.ft.CorruptRate {
+			p[i] ^= 0xff
+		}
+	}
+}
+
+// throttle sleeps long enough that n bytes stay within the
+// configured bandwidth cap.
+func (c *faultConn) throttle(n int) {
+	if lim := c.ft.BytesPerSecond; lim > 0 && n > 0 {
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(lim))
+	}
+}
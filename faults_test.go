@@ -0,0 +1,96 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connTarget is a Target that hands received conns to a channel.
+type connTarget chan net.Conn
+
+func (t connTarget) HandleConn(c net.Conn) { t <- c }
+
+func faultyPipe(ft *FaultTarget) (faulty, peer net.Conn) {
+	got := make(connTarget, 1)
+	ft.Target = got
+	a, b := net.Pipe()
+	ft.HandleConn(a)
+	return <-got, b
+}
+
+func TestFaultTargetCorrupt(t *testing.T) {
+	c, peer := faultyPipe(&FaultTarget{CorruptRate: 1})
+	defer c.Close()
+	defer peer.Close()
+
+	msg := []byte("hello")
+	go c.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := range buf {
+		if buf[i] != msg[i]^0xff {
+			t.Fatalf("byte %d = %#x; want corrupted %#x", i, buf[i], msg[i]^0xff)
+		}
+	}
+	if string(msg) != "hello" {
+		t.Fatalf("Write modified caller's buffer: %q", msg)
+	}
+}
+
+func TestFaultTargetReset(t *testing.T) {
+	c, peer := faultyPipe(&FaultTarget{ResetRate: 1})
+	defer peer.Close()
+
+	if _, err := c.Read(make([]byte, 1)); err != errInjectedReset {
+		t.Fatalf("Read error = %v; want %v", err, errInjectedReset)
+	}
+}
+
+func TestFaultTargetLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	c, peer := faultyPipe(&FaultTarget{Latency: latency})
+	defer c.Close()
+	defer peer.Close()
+
+	go peer.Write([]byte("x"))
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < latency {
+		t.Fatalf("Read took %v; want at least %v", d, latency)
+	}
+}
+
+func TestFaultTargetKeepsConn(t *testing.T) {
+	got := make(connTarget, 1)
+	ft := &FaultTarget{Target: got, CorruptRate: 1}
+	a, _ := net.Pipe()
+	ft.HandleConn(&Conn{HostName: "foo.com", Peeked: []byte("abc"), Conn: a})
+
+	wc, ok := (<-got).(*Conn)
+	if !ok {
+		t.Fatal("FaultTarget did not preserve *Conn")
+	}
+	if wc.HostName != "foo.com" || string(wc.Peeked) != "abc" {
+		t.Fatalf("got HostName %q Peeked %q", wc.HostName, wc.Peeked)
+	}
+}
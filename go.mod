@@ -5,4 +5,5 @@ go 1.13
 require (
 	github.com/armon/go-proxyproto v0.0.0-20200108142055-f0b8253b1507
 	github.com/google/uuid v1.1.2
+	golang.org/x/net v0.17.0
 )
@@ -0,0 +1,212 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TargetGroup implements Target by spreading connections over a
+// changing set of member Targets, in proportion to their weights.
+//
+// Members can be added with a slow start, so a freshly started
+// backend receives a gradually increasing share of new connections,
+// and removed by draining, so a backend being shut down receives no
+// new connections while its existing ones finish.
+//
+// Member Targets must handle connections synchronously, as DialProxy
+// does, for draining to know when a member's connections are done.
+//
+// The zero value is an empty group, ready to use.
+type TargetGroup struct {
+	// SlowStart optionally specifies how long it takes a newly
+	// added member to ramp up linearly to its full weight.
+	// If zero, members get their full weight immediately.
+	SlowStart time.Duration
+
+	mu      sync.Mutex
+	members []*groupMember
+}
+
+type groupMember struct {
+	id      uuid.UUID
+	target  Target
+	weight  int
+	added   time.Time
+	active  int           // connections being handled; guarded by TargetGroup.mu
+	drained chan struct{} // non-nil once draining; closed when active reaches 0
+}
+
+// A GroupMember describes a member of a TargetGroup.
+type GroupMember struct {
+	Id     uuid.UUID
+	Target Target
+
+	// Weight is the member's configured weight, and
+	// EffectiveWeight its current weight during slow start.
+	Weight          int
+	EffectiveWeight float64
+
+	Active   int  // connections currently being handled
+	Draining bool // whether the member is draining
+}
+
+// Add adds t to the group with the given weight and returns an id
+// that can be used to drain it. Weights less than 1 are treated as 1.
+func (g *TargetGroup) Add(t Target, weight int) uuid.UUID {
+	if weight < 1 {
+		weight = 1
+	}
+	m := &groupMember{
+		id:     uuid.New(),
+		target: t,
+		weight: weight,
+		added:  time.Now(),
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members = append(g.members, m)
+	return m.id
+}
+
+// Drain stops sending new connections to the member id and removes
+// it from the group once its existing connections are done. The
+// returned channel is closed at that point. Draining an unknown or
+// already removed member returns a closed channel.
+func (g *TargetGroup) Drain(id uuid.UUID) <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, m := range g.members {
+		if m.id != id {
+			continue
+		}
+		if m.drained == nil {
+			m.drained = make(chan struct{})
+			g.removeIfDrainedLocked(m)
+		}
+		return m.drained
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// Members returns a snapshot of the group's members, including those
+// still draining.
+func (g *TargetGroup) Members() []GroupMember {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := make([]GroupMember, 0, len(g.members))
+	for _, m := range g.members {
+		ms = append(ms, GroupMember{
+			Id:              m.id,
+			Target:          m.target,
+			Weight:          m.weight,
+			EffectiveWeight: g.effectiveWeight(m, now),
+			Active:          m.active,
+			Draining:        m.drained != nil,
+		})
+	}
+	return ms
+}
+
+// HandleConn implements the Target interface.
+func (g *TargetGroup) HandleConn(c net.Conn) {
+	m := g.pick()
+	if m == nil {
+		log.Printf("tcpproxy: for incoming conn %v, target group has no available members", c.RemoteAddr())
+		shed(c)
+		return
+	}
+	defer g.done(m)
+	m.target.HandleConn(c)
+}
+
+// pick chooses a non-draining member at random, weighted by its
+// effective weight, and counts a connection against it.
+func (g *TargetGroup) pick() *groupMember {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var total float64
+	for _, m := range g.members {
+		if m.drained == nil {
+			total += g.effectiveWeight(m, now)
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	r := rand.Float64() * total
+	var picked *groupMember
+	for _, m := range g.members {
+		if m.drained != nil {
+			continue
+		}
+		picked = m
+		if r -= g.effectiveWeight(m, now); r < 0 {
+			break
+		}
+	}
+	picked.active++
+	return picked
+}
+
+func (g *TargetGroup) done(m *groupMember) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m.active--
+	g.removeIfDrainedLocked(m)
+}
+
+func (g *TargetGroup) removeIfDrainedLocked(m *groupMember) {
+	if m.drained == nil || m.active > 0 {
+		return
+	}
+	for i, other := range g.members {
+		if other == m {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			close(m.drained)
+			return
+		}
+	}
+}
+
+// effectiveWeight returns m's weight at time now, taking SlowStart
+// into account. A member starting up always gets a small share, so
+// that it is not starved entirely.
+func (g *TargetGroup) effectiveWeight(m *groupMember, now time.Time) float64 {
+	w := float64(m.weight)
+	if g.SlowStart <= 0 {
+		return w
+	}
+	age := now.Sub(m.added)
+	if age >= g.SlowStart {
+		return w
+	}
+	const minShare = 0.05
+	share := float64(age) / float64(g.SlowStart)
+	if share < minShare {
+		share = minShare
+	}
+	return w * share
+}
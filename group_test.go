@@ -0,0 +1,97 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingTarget is a Target that holds each conn until it is closed.
+type blockingTarget struct {
+	got chan net.Conn
+}
+
+func (t blockingTarget) HandleConn(c net.Conn) {
+	t.got <- c
+	c.Read(make([]byte, 1))
+}
+
+func TestTargetGroupWeights(t *testing.T) {
+	var g TargetGroup
+	a, b := make(connTarget, 1000), make(connTarget, 1000)
+	g.Add(a, 3)
+	g.Add(b, 1)
+	for i := 0; i < 1000; i++ {
+		c, _ := net.Pipe()
+		g.HandleConn(c)
+	}
+	if n := len(a); n < 650 || n > 850 {
+		t.Errorf("weight 3 member got %d of 1000 conns; want about 750", n)
+	}
+}
+
+func TestTargetGroupSlowStart(t *testing.T) {
+	g := &TargetGroup{SlowStart: time.Hour}
+	g.Add(noopTarget{}, 10)
+	ms := g.Members()
+	if len(ms) != 1 {
+		t.Fatalf("got %d members; want 1", len(ms))
+	}
+	if w := ms[0].EffectiveWeight; w <= 0 || w >= 1 {
+		t.Errorf("EffectiveWeight just after Add = %v; want small but positive", w)
+	}
+
+	g.members[0].added = time.Now().Add(-30 * time.Minute)
+	if w := g.Members()[0].EffectiveWeight; w < 4.9 || w > 5.1 {
+		t.Errorf("EffectiveWeight halfway through slow start = %v; want 5", w)
+	}
+}
+
+func TestTargetGroupDrain(t *testing.T) {
+	var g TargetGroup
+	old := blockingTarget{make(chan net.Conn, 1)}
+	id := g.Add(old, 1)
+
+	client, c := net.Pipe()
+	go g.HandleConn(c)
+	<-old.got
+
+	drained := g.Drain(id)
+	next := make(connTarget, 1)
+	g.Add(next, 1)
+
+	c2, _ := net.Pipe()
+	g.HandleConn(c2)
+	if len(next) != 1 {
+		t.Fatal("new conn was not sent to the non-draining member")
+	}
+	select {
+	case <-drained:
+		t.Fatal("drained before the existing conn finished")
+	default:
+	}
+
+	client.Close()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for drain")
+	}
+	if n := len(g.Members()); n != 1 {
+		t.Errorf("got %d members after drain; want 1", n)
+	}
+}
@@ -18,7 +18,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -30,7 +36,15 @@ import (
 //
 // The ipPort is any valid net.Listen TCP address.
 func (p *Proxy) AddHTTPHostRoute(ipPort, httpHost string, dest Target) uuid.UUID {
-	return p.AddHTTPHostMatchRoute(ipPort, equals(httpHost), dest)
+	return p.addHTTPHostRoute(ipPort, httpHost, dest, uuid.New())
+}
+
+// addHTTPHostRoute is AddHTTPHostRoute with the route id chosen by
+// the caller.
+func (p *Proxy) addHTTPHostRoute(ipPort, httpHost string, dest Target, routeId uuid.UUID) uuid.UUID {
+	p.addRouteWithId(ipPort, httpHostMatch{equals(httpHost), dest}, routeId)
+	p.configFor(ipPort).setRouteName(routeId, httpHost)
+	return routeId
 }
 
 func (p *Proxy) AddHTTPDynamicRoute(ipPort string, targetLookup TargetLookup) uuid.UUID {
@@ -51,10 +65,10 @@ type dynamicHTTPMatch struct {
 	dynMatcher TargetLookup
 }
 
-func (m dynamicHTTPMatch) match(br *bufio.Reader) (Target, string) {
-	sni := clientHelloServerName(br)
+func (m dynamicHTTPMatch) match(ctx context.Context, br *bufio.Reader) (Target, string) {
+	sni := canonicalName(ctx, clientHelloServerName(br))
 
-	targetAddr, err := m.dynMatcher(context.TODO(), sni)
+	targetAddr, err := m.dynMatcher(ctx, sni)
 
 	if err != nil {
 		return nil, ""
@@ -68,9 +82,9 @@ type httpHostMatch struct {
 	target  Target
 }
 
-func (m httpHostMatch) match(br *bufio.Reader) (Target, string) {
-	hh := httpHostHeader(br)
-	if m.matcher(context.TODO(), hh) {
+func (m httpHostMatch) match(ctx context.Context, br *bufio.Reader) (Target, string) {
+	hh := canonicalName(ctx, httpHostHeader(br))
+	if m.matcher(ctx, hh) {
 		return m.target, hh
 	}
 	return nil, ""
@@ -79,7 +93,7 @@ func (m httpHostMatch) match(br *bufio.Reader) (Target, string) {
 // httpHostHeader returns the HTTP Host header from br without
 // consuming any of its bytes. It returns "" if it can't find one.
 func httpHostHeader(br *bufio.Reader) string {
-	const maxPeek = 4 << 10
+	maxPeek := br.Size()
 	peekSize := 0
 	for {
 		peekSize++
@@ -145,3 +159,113 @@ func untilEOL(v []byte) []byte {
 	}
 	return v
 }
+
+// maxForwardedHeader bounds how much of a request header
+// sendForwardedRequest will buffer while rewriting it.
+const maxForwardedHeader = 64 << 10
+
+// defaultForwardedHeaderTimeout is how long sendForwardedRequest
+// waits for the request header when the Proxy has no SniffTimeout.
+const defaultForwardedHeaderTimeout = 30 * time.Second
+
+// sendForwardedRequest reads the first HTTP request header from src,
+// and writes it to w with X-Forwarded-For, X-Real-IP and
+// X-Forwarded-Proto set for src's remote address. It returns a conn
+// to continue proxying from, which replays any bytes read past the
+// header.
+//
+// If src wasn't routed on bytes that look like an HTTP request,
+// nothing is read and src is returned unchanged.
+func (dp *DialProxy) sendForwardedRequest(w io.Writer, src net.Conn) (net.Conn, error) {
+	addr, ok := src.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return src, nil
+	}
+	wc, ok := src.(*Conn)
+	if !ok || len(wc.Peeked) == 0 {
+		// Don't wait for a request from a client that may be
+		// waiting for the server to speak first.
+		return src, nil
+	}
+	timeout := wc.sniffTimeout
+	if timeout <= 0 {
+		timeout = defaultForwardedHeaderTimeout
+	}
+	src.SetReadDeadline(time.Now().Add(timeout))
+	defer src.SetReadDeadline(time.Time{})
+
+	// The limit keeps a header line without a newline from being
+	// buffered without bound.
+	br := bufio.NewReader(io.LimitReader(src, maxForwardedHeader))
+	if b, err := br.Peek(1); err != nil || b[0] < 'A' || b[0] > 'Z' {
+		return dp.resumeAfter(br, src), nil
+	}
+
+	var lines [][]byte
+	size := 0
+	for {
+		line, err := br.ReadBytes('\n')
+		size += len(line)
+		if size >= maxForwardedHeader {
+			return src, errors.New("HTTP request header too large")
+		}
+		if err != nil {
+			return src, fmt.Errorf("reading HTTP request header: %v", err)
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	ip := unmapIP(addr.IP).String()
+	var xff []string
+	var out bytes.Buffer
+	for i, line := range lines {
+		if i > 0 {
+			name, value := headerNameValue(line)
+			switch {
+			case strings.EqualFold(name, "X-Forwarded-For"):
+				xff = append(xff, value)
+				continue
+			case strings.EqualFold(name, "X-Real-Ip"),
+				strings.EqualFold(name, "X-Forwarded-Proto"):
+				continue
+			}
+		}
+		out.Write(line)
+	}
+	proto := dp.ForwardedProto
+	if proto == "" {
+		proto = "http"
+	}
+	fmt.Fprintf(&out, "X-Forwarded-For: %s\r\nX-Real-Ip: %s\r\nX-Forwarded-Proto: %s\r\n\r\n", strings.Join(append(xff, ip), ", "), ip, proto)
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return src, err
+	}
+	return dp.resumeAfter(br, src), nil
+}
+
+// resumeAfter returns a conn that yields the bytes buffered in br,
+// followed by the rest of src.
+func (dp *DialProxy) resumeAfter(br *bufio.Reader, src net.Conn) net.Conn {
+	var hostName string
+	if wc, ok := src.(*Conn); ok {
+		hostName = wc.HostName
+	}
+	peeked, _ := br.Peek(br.Buffered())
+	return &Conn{
+		HostName: hostName,
+		Peeked:   peeked,
+		Conn:     UnderlyingConn(src),
+	}
+}
+
+// headerNameValue splits a raw "Name: value" header line.
+func headerNameValue(line []byte) (name, value string) {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		return "", ""
+	}
+	return string(bytes.TrimSpace(line[:i])), string(bytes.TrimSpace(line[i+1:]))
+}
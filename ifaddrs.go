@@ -0,0 +1,224 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// anyPrivate is the listener host that expands to every private
+// address on the host.
+const anyPrivate = "any-private"
+
+// interfaceAddrs returns the addresses assigned to network
+// interfaces. It is a variable so tests can fake the host's
+// interfaces.
+var interfaceAddrs = func(name string) ([]net.Addr, error) {
+	if name == "" {
+		return net.InterfaceAddrs()
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return ifi.Addrs()
+}
+
+// isTemplate reports whether host names an interface or address
+// class rather than a literal address or hostname.
+func isTemplate(host string) bool {
+	if host == anyPrivate {
+		return true
+	}
+	if host == "" || strings.HasPrefix(host, "unix:") || net.ParseIP(host) != nil {
+		return false
+	}
+	_, err := interfaceAddrs(host)
+	return err == nil
+}
+
+// resolveListenAddrs expands the ipPort listener spec into the
+// addresses to listen on. Specs that aren't templates are returned
+// unchanged. Templated specs are remembered so the interface watcher
+// can re-resolve them; if a remembered spec's interface goes away,
+// it has no addresses until the interface returns.
+func (p *Proxy) resolveListenAddrs(ipPort string) ([]string, error) {
+	if strings.HasPrefix(ipPort, "unix:") {
+		return []string{ipPort}, nil
+	}
+	host, port, err := net.SplitHostPort(ipPort)
+	if err != nil {
+		// Let the listen call report the error.
+		return []string{ipPort}, nil
+	}
+	p.mu.Lock()
+	_, known := p.templated[ipPort]
+	p.mu.Unlock()
+	if !known && !isTemplate(host) {
+		return []string{ipPort}, nil
+	}
+
+	p.mu.Lock()
+	if p.templated == nil {
+		p.templated = make(map[string]map[string]net.Listener)
+	}
+	if p.templated[ipPort] == nil {
+		p.templated[ipPort] = make(map[string]net.Listener)
+	}
+	p.mu.Unlock()
+
+	var addrs []net.Addr
+	if host == anyPrivate {
+		addrs, err = interfaceAddrs("")
+	} else {
+		addrs, err = interfaceAddrs(host)
+	}
+	if err != nil {
+		if known {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ret []string
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if !p.IPFamily.allows(ipn.IP) {
+			continue
+		}
+		if host == anyPrivate && !isPrivateIP(ipn.IP) {
+			continue
+		}
+		ret = append(ret, net.JoinHostPort(ipn.IP.String(), port))
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+var privateNets = []net.IPNet{
+	{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+	{IP: net.IP{172, 16, 0, 0}, Mask: net.CIDRMask(12, 32)},
+	{IP: net.IP{192, 168, 0, 0}, Mask: net.CIDRMask(16, 32)},
+	{IP: net.IP{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(7, 128)},
+}
+
+// isPrivateIP reports whether ip is an RFC 1918 or RFC 4193 address.
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// takeRetired reports whether ln was closed by the interface
+// watcher, as opposed to failing or being closed by Close. It is
+// called once ln's accept loop has stopped, so it also forgets ln;
+// connections ln accepted don't need the entry.
+func (p *Proxy) takeRetired(ln net.Listener) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	retired := p.retiredLn[ln]
+	delete(p.retiredLn, ln)
+	return retired
+}
+
+// watchInterfaces re-resolves templated listener specs every
+// p.InterfaceRefresh until stopc is closed.
+func (p *Proxy) watchInterfaces(errc chan<- error, stopc <-chan struct{}) {
+	t := time.NewTicker(p.InterfaceRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopc:
+			return
+		case <-t.C:
+			p.refreshListeners(errc)
+		}
+	}
+}
+
+// refreshListeners opens listeners for newly resolved addresses of
+// templated specs, and closes listeners whose address is gone.
+func (p *Proxy) refreshListeners(errc chan<- error) {
+	p.mu.Lock()
+	specs := make([]string, 0, len(p.templated))
+	for ipPort := range p.templated {
+		specs = append(specs, ipPort)
+	}
+	p.mu.Unlock()
+
+	for _, ipPort := range specs {
+		addrs, err := p.resolveListenAddrs(ipPort)
+		if err != nil {
+			log.Printf("tcpproxy: re-resolving listener %q: %v", ipPort, err)
+			continue
+		}
+		want := make(map[string]bool, len(addrs))
+		for _, addr := range addrs {
+			want[addr] = true
+		}
+
+		p.mu.Lock()
+		current := p.templated[ipPort]
+		var add []string
+		for _, addr := range addrs {
+			if current[addr] == nil {
+				add = append(add, addr)
+			}
+		}
+		for addr, ln := range current {
+			if !want[addr] {
+				log.Printf("tcpproxy: address %s of listener %q went away; closing", addr, ipPort)
+				if p.retiredLn == nil {
+					p.retiredLn = make(map[net.Listener]bool)
+				}
+				p.retiredLn[ln] = true
+				delete(current, addr)
+				p.removeListenerLocked(ln)
+				ln.Close()
+			}
+		}
+		cfg := p.configs[ipPort]
+		p.mu.Unlock()
+
+		for _, addr := range add {
+			if err := p.startListener(errc, ipPort, addr, cfg); err != nil {
+				log.Printf("tcpproxy: listening on %s for listener %q: %v", addr, ipPort, err)
+			}
+		}
+	}
+}
+
+// removeListenerLocked removes ln from p.lns. p.mu must be held.
+func (p *Proxy) removeListenerLocked(ln net.Listener) {
+	for i, l := range p.lns {
+		if l == ln {
+			p.lns = append(p.lns[:i], p.lns[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeInterfaces replaces the host's interfaces for the duration of
+// a test. The returned func updates the addresses of fake0.
+func fakeInterfaces(t *testing.T) (set func(cidrs ...string), restore func()) {
+	var (
+		mu    sync.Mutex
+		addrs []net.Addr
+	)
+	old := interfaceAddrs
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		if name != "" && name != "fake0" {
+			return nil, errors.New("no such interface")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return addrs, nil
+	}
+	set = func(cidrs ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		addrs = nil
+		for _, c := range cidrs {
+			ip, ipn, err := net.ParseCIDR(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ipn.IP = ip
+			addrs = append(addrs, ipn)
+		}
+	}
+	return set, func() { interfaceAddrs = old }
+}
+
+func TestResolveListenAddrs(t *testing.T) {
+	set, restore := fakeInterfaces(t)
+	defer restore()
+	set("10.1.2.3/8", "8.8.8.8/32", "fe80::1/64", "fd00::1/64")
+
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"1.2.3.4:443", []string{"1.2.3.4:443"}},
+		{":443", []string{":443"}},
+		{"unix:/tmp/x", []string{"unix:/tmp/x"}},
+		{"fake0:443", []string{"10.1.2.3:443", "8.8.8.8:443", "[fd00::1]:443"}},
+		{"any-private:25", []string{"10.1.2.3:25", "[fd00::1]:25"}},
+	}
+	for _, tt := range tests {
+		var p Proxy
+		got, err := p.resolveListenAddrs(tt.spec)
+		if err != nil {
+			t.Errorf("resolveListenAddrs(%q) error: %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("resolveListenAddrs(%q) = %q; want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestProxyInterfaceRefresh(t *testing.T) {
+	set, restore := fakeInterfaces(t)
+	defer restore()
+	set("10.0.0.1/8")
+
+	var mu sync.Mutex
+	listened := map[string]net.Listener{}
+	p := &Proxy{
+		ListenFunc: func(network, laddr string) (net.Listener, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			ln := newLocalListener(t)
+			listened[laddr] = ln
+			return ln, nil
+		},
+	}
+	p.AddRoute("fake0:443", noopTarget{})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	set("10.0.0.2/8")
+	errc := make(chan error, 1)
+	p.refreshListeners(errc)
+
+	p.mu.Lock()
+	var got []string
+	for addr := range p.templated["fake0:443"] {
+		got = append(got, addr)
+	}
+	nlns := len(p.lns)
+	p.mu.Unlock()
+	sort.Strings(got)
+	if want := []string{"10.0.0.2:443"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("listening on %q; want %q", got, want)
+	}
+	if nlns != 1 {
+		t.Fatalf("proxy has %d listeners; want 1", nlns)
+	}
+
+	mu.Lock()
+	old := listened["10.0.0.1:443"]
+	mu.Unlock()
+	if _, err := old.Accept(); err == nil {
+		t.Fatal("listener for removed address still open")
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("retired listener reported error %v", err)
+	default:
+	}
+	// The retired listener is forgotten once its accept loop stops.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		p.mu.Lock()
+		n := len(p.retiredLn)
+		p.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d retired listeners still tracked", n)
+		}
+	}
+
+	// If the interface disappears, its spec has no addresses rather
+	// than being listened on literally.
+	interfaceAddrs = func(string) ([]net.Addr, error) {
+		return nil, errors.New("no such interface")
+	}
+	p.refreshListeners(errc)
+	p.mu.Lock()
+	n, nlns := len(p.templated["fake0:443"]), len(p.lns)
+	p.mu.Unlock()
+	mu.Lock()
+	_, literal := listened["fake0:443"]
+	mu.Unlock()
+	if n != 0 || nlns != 0 || literal {
+		t.Errorf("after interface removal, %d addresses and %d listeners (literal spec listened on: %v); want none", n, nlns, literal)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// An IPFamily selects which IP versions the proxy's TCP listeners
+// accept connections over.
+type IPFamily int
+
+const (
+	// IPFamilyDefault listens as net.Listen does for "tcp": a
+	// wildcard address accepts both IPv4 and IPv6 where the system
+	// supports it, and a literal address accepts its own family.
+	IPFamilyDefault IPFamily = iota
+
+	// IPv4Only listens on IPv4 addresses only. A wildcard address
+	// such as ":443" binds 0.0.0.0.
+	IPv4Only
+
+	// IPv6Only listens on IPv6 addresses only. Sockets are created
+	// with IPV6_V6ONLY set, so a wildcard address such as ":443"
+	// doesn't accept IPv4 connections, leaving the IPv4 port free
+	// for another listener.
+	IPv6Only
+
+	// DualStack listens on a single IPv6 socket with IPV6_V6ONLY
+	// cleared, accepting IPv4 connections as v4-mapped IPv6
+	// addresses, regardless of the system's default. The listener
+	// address must be a wildcard.
+	DualStack
+)
+
+func (f IPFamily) String() string {
+	switch f {
+	case IPFamilyDefault:
+		return "default"
+	case IPv4Only:
+		return "ipv4-only"
+	case IPv6Only:
+		return "ipv6-only"
+	case DualStack:
+		return "dual-stack"
+	}
+	return fmt.Sprintf("IPFamily(%d)", int(f))
+}
+
+// network returns the net.Listen network for a TCP listener on addr.
+// The net package sets IPV6_V6ONLY on the socket to match: on for
+// "tcp6", and off for a wildcard "tcp" address.
+func (f IPFamily) network(addr string) (string, error) {
+	switch f {
+	case IPv4Only:
+		return "tcp4", nil
+	case IPv6Only:
+		return "tcp6", nil
+	case DualStack:
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", err
+		}
+		if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+			return "", fmt.Errorf("tcpproxy: dual-stack listener %q must use a wildcard address", addr)
+		}
+		return "tcp", nil
+	}
+	return "tcp", nil
+}
+
+// allows reports whether a listener of family f can bind ip. It is
+// used to filter the addresses of templated listeners.
+func (f IPFamily) allows(ip net.IP) bool {
+	switch f {
+	case IPv4Only:
+		return ip.To4() != nil
+	case IPv6Only:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// unmapIP returns ip in its 4-byte form if it is an IPv4 or v4-mapped
+// IPv6 address, so that a client is keyed the same way whether it
+// connected to an IPv4 or a dual-stack listener.
+func unmapIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// ipv6String formats ip as an IPv6 address, writing IPv4 addresses in
+// their v4-mapped form.
+func ipv6String(ip net.IP) string {
+	if len(ip) == net.IPv4len {
+		return "::ffff:" + ip.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestIPFamilyListeners(t *testing.T) {
+	ln6, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	ln6.Close()
+
+	tests := []struct {
+		family IPFamily
+		want4  bool
+		want6  bool
+	}{
+		{IPv4Only, true, false},
+		{IPv6Only, false, true},
+		{DualStack, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.family.String(), func(t *testing.T) {
+			p := &Proxy{IPFamily: tt.family}
+			p.AddRoute(":0", noopTarget{})
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			_, port, _ := net.SplitHostPort(p.lns[0].Addr().String())
+
+			for _, c := range []struct {
+				host string
+				want bool
+			}{
+				{"127.0.0.1", tt.want4},
+				{"::1", tt.want6},
+			} {
+				conn, err := net.Dial("tcp", net.JoinHostPort(c.host, port))
+				if got := err == nil; got != c.want {
+					t.Errorf("dial %s: err = %v; want success %v", c.host, err, c.want)
+				}
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		})
+	}
+}
+
+func TestIPFamilyDualStackNeedsWildcard(t *testing.T) {
+	p := &Proxy{IPFamily: DualStack}
+	p.AddRoute("127.0.0.1:0", noopTarget{})
+	if err := p.Start(); err == nil {
+		p.Close()
+		t.Fatal("Start succeeded; want error for non-wildcard dual-stack listener")
+	}
+}
+
+func TestIPFamilyAllows(t *testing.T) {
+	v4, mapped, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("::ffff:192.0.2.1"), net.ParseIP("2001:db8::1")
+	if !IPv4Only.allows(v4) || !IPv4Only.allows(mapped) || IPv4Only.allows(v6) {
+		t.Error("IPv4Only should allow only IPv4 addresses")
+	}
+	if IPv6Only.allows(v4) || !IPv6Only.allows(v6) {
+		t.Error("IPv6Only should allow only IPv6 addresses")
+	}
+	if !DualStack.allows(v4) || !DualStack.allows(v6) {
+		t.Error("DualStack should allow both families")
+	}
+}
+
+func TestClientIPUnmapsV4(t *testing.T) {
+	a, _ := net.Pipe()
+	c := remoteAddrConn{a, &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1234}}
+	if got, want := clientIP(c), "192.0.2.1"; got != want {
+		t.Errorf("clientIP = %q; want %q", got, want)
+	}
+}
+
+func TestProxyHeaderMappedAddrs(t *testing.T) {
+	a, _ := net.Pipe()
+	tests := []struct {
+		src, dst string
+		want     string
+	}{
+		{"::ffff:192.0.2.1", "::ffff:198.51.100.1", "PROXY TCP4 192.0.2.1 1234 198.51.100.1 443\r\n"},
+		{"2001:db8::1", "2001:db8::2", "PROXY TCP6 2001:db8::1 1234 2001:db8::2 443\r\n"},
+		{"192.0.2.1", "2001:db8::2", "PROXY TCP6 ::ffff:192.0.2.1 1234 2001:db8::2 443\r\n"},
+	}
+	for _, tt := range tests {
+		src := localAddrConn{
+			remoteAddrConn{a, &net.TCPAddr{IP: net.ParseIP(tt.src), Port: 1234}},
+			&net.TCPAddr{IP: net.ParseIP(tt.dst), Port: 443},
+		}
+		var buf bytes.Buffer
+		dp := &DialProxy{ProxyProtocolVersion: 1}
+		if err := dp.sendProxyHeader(&buf, src); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("header for %s -> %s = %q; want %q", tt.src, tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestIPFamilyNetwork(t *testing.T) {
+	tests := []struct {
+		family  IPFamily
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{IPFamilyDefault, ":443", "tcp", false},
+		{IPv4Only, ":443", "tcp4", false},
+		{IPv6Only, ":443", "tcp6", false},
+		{DualStack, ":443", "tcp", false},
+		{DualStack, "[::]:443", "tcp", false},
+		{DualStack, "192.0.2.1:443", "", true},
+		{DualStack, "example.com:443", "", true},
+	}
+	for _, tt := range tests {
+		got, err := tt.family.network(tt.addr)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%v.network(%q) = %q, %v; want %q, error %v", tt.family, tt.addr, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
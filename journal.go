@@ -0,0 +1,229 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// journalEntry is one line of a route journal: a route added or
+// removed through the admin API.
+type journalEntry struct {
+	Op    string      `json:"op"` // "add" or "remove"
+	Id    uuid.UUID   `json:"id"`
+	Route *AdminRoute `json:"route,omitempty"` // for "add"
+}
+
+// routeJournal appends route changes to a file. Proxy.journal is
+// guarded by Proxy.mu, as is unrestored, but writes are serialized by
+// the journal's own mu, so that waiting for the disk doesn't hold up
+// routing.
+type routeJournal struct {
+	mu sync.Mutex
+	f  *os.File // nil once closed
+
+	// unrestored holds the journaled routes that couldn't be
+	// restored, say because a quota was lowered or a listener
+	// removed. They stay in the journal, to be restored by a later
+	// start once the configuration allows, until removed through
+	// the admin API.
+	unrestored map[uuid.UUID]*AdminRoute
+}
+
+// restoreRoutes replays p.RouteJournal, re-adding with their
+// original ids the routes that were added through the admin API and
+// not removed since, then rewrites the journal to hold just those
+// routes and opens it for appending. Routes that can't be restored
+// are logged and kept in the journal rather than failing the start.
+func (p *Proxy) restoreRoutes() error {
+	if p.RouteJournal == "" {
+		return nil
+	}
+	entries, err := readJournal(p.RouteJournal)
+	if err != nil {
+		return err
+	}
+
+	unrestored := make(map[uuid.UUID]*AdminRoute)
+	for _, e := range entries {
+		if _, err := p.addAdminRoute(e.Route, e.Id); err != nil {
+			log.Printf("tcpproxy: not restoring route %v %+v: %v", e.Id, *e.Route, err)
+			unrestored[e.Id] = e.Route
+		}
+	}
+	if err := writeJournal(p.RouteJournal, entries); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p.RouteJournal, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.journal = &routeJournal{f: f, unrestored: unrestored}
+	p.mu.Unlock()
+	return nil
+}
+
+// forgetUnrestored drops the unrestored journaled route routeId of
+// namespace ns, reporting whether there was one. The caller journals
+// its removal.
+func (p *Proxy) forgetUnrestored(ns string, routeId uuid.UUID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.journal == nil {
+		return false
+	}
+	ar := p.journal.unrestored[routeId]
+	if ar == nil || ar.Namespace != ns {
+		return false
+	}
+	delete(p.journal.unrestored, routeId)
+	return true
+}
+
+// readJournal returns the "add" entries of the journal at path whose
+// routes haven't been removed since, in the order they were added. A
+// missing journal holds no routes. A truncated final line, as left by
+// a crash during a write, is ignored.
+func readJournal(path string) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		order  []uuid.UUID
+		routes = make(map[uuid.UUID]*AdminRoute)
+		bad    error
+	)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		if bad != nil {
+			return nil, bad
+		}
+		var e journalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			bad = fmt.Errorf("tcpproxy: route journal %s:%d: %v", path, line, err)
+			continue
+		}
+		switch e.Op {
+		case "add":
+			if e.Route == nil {
+				return nil, fmt.Errorf("tcpproxy: route journal %s:%d: add without route", path, line)
+			}
+			order = append(order, e.Id)
+			routes[e.Id] = e.Route
+		case "remove":
+			delete(routes, e.Id)
+		default:
+			return nil, fmt.Errorf("tcpproxy: route journal %s:%d: unknown op %q", path, line, e.Op)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	var live []journalEntry
+	for _, id := range order {
+		if ar := routes[id]; ar != nil {
+			live = append(live, journalEntry{Op: "add", Id: id, Route: ar})
+			delete(routes, id)
+		}
+	}
+	return live, nil
+}
+
+// writeJournal atomically replaces the journal at path with entries.
+func writeJournal(path string, entries []journalEntry) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	for _, e := range entries {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// logRouteChange appends e to p's route journal, if it has one, and
+// waits for it to reach stable storage. Writes are serialized, so a
+// removal is always journaled after the addition it undoes, which
+// was journaled before the route's id was handed out.
+func (p *Proxy) logRouteChange(e journalEntry) error {
+	p.mu.Lock()
+	j := p.journal
+	p.mu.Unlock()
+	if j == nil {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return errors.New("tcpproxy: route journal closed")
+	}
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// closeJournal closes p's route journal, waiting for any write in
+// progress. p.mu must be held.
+func (p *Proxy) closeJournal() {
+	j := p.journal
+	if j == nil {
+		return
+	}
+	p.journal = nil
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.f.Close()
+	j.f = nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRouteJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcpproxy-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "routes.jsonl")
+
+	start := func() *Proxy {
+		p := testProxy(t, newLocalListener(t))
+		p.RouteJournal = journal
+		p.AddRoute(testFrontAddr, noopTarget{})
+		p.Namespace("team-a").SetScope(NamespaceScope{
+			Listeners: []string{testFrontAddr},
+			Suffixes:  []string{"example.com"},
+			Backends:  []string{"10.0.0.0/8"},
+		})
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	addRoute := func(p *Proxy, name string) uuid.UUID {
+		body := `{"namespace":"team-a","listener":"` + testFrontAddr + `","kind":"sni","name":"` + name + `","addr":"10.0.0.1:443"}`
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/routes", strings.NewReader(body)))
+		var added struct{ Id uuid.UUID }
+		if err := json.NewDecoder(rec.Body).Decode(&added); err != nil {
+			t.Fatalf("adding %s: %d: %v", name, rec.Code, err)
+		}
+		return added.Id
+	}
+	names := func(p *Proxy) (names []string) {
+		for _, r := range p.DumpConfig().Listeners[0].Routes {
+			if r.Match != "" {
+				names = append(names, r.Match)
+			}
+		}
+		return names
+	}
+
+	p := start()
+	idA := addRoute(p, "a.example.com")
+	id := addRoute(p, "b.example.com")
+	addRoute(p, "c.example.com")
+	rec := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(rec, httptest.NewRequest("DELETE", "/routes?namespace=team-a&id="+id.String(), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d", rec.Code)
+	}
+	p.Close()
+
+	// A route for a listener that's no longer configured, and a
+	// crash in the middle of appending an entry.
+	f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := uuid.New()
+	f.WriteString(`{"op":"add","id":"` + gone.String() + `","route":{"namespace":"team-a","listener":":1","kind":"sni","name":"d.example.com","addr":"10.0.0.1:443"}}` + "\n")
+	f.WriteString(`{"op":"add","id":`)
+	f.Close()
+
+	p = start()
+	defer p.Close()
+	if got, want := strings.Join(names(p), ","), "a.example.com,c.example.com"; got != want {
+		t.Errorf("restored routes %q; want %q", got, want)
+	}
+	if n := p.Namespace("team-a").Stats().Routes; n != 2 {
+		t.Errorf("restored namespace has %d routes; want 2", n)
+	}
+	if _, ok := p.Namespace("team-a").RouteIds()[idA]; !ok {
+		t.Errorf("restored routes %v don't include the original id %v", p.Namespace("team-a").RouteIds(), idA)
+	}
+
+	journalLines := func() int {
+		b, err := ioutil.ReadFile(journal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(b), "\n")
+	}
+	// The unrestorable route is kept until it's removed.
+	if n := journalLines(); n != 3 {
+		t.Errorf("compacted journal has %d lines; want 3", n)
+	}
+	rec = httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(rec, httptest.NewRequest("DELETE", "/routes?namespace=team-a&id="+gone.String(), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE unrestored route = %d", rec.Code)
+	}
+	if n := journalLines(); n != 4 {
+		t.Errorf("journal has %d lines after removal; want 4", n)
+	}
+}
+
+func TestRouteJournalConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcpproxy-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "routes.jsonl")
+
+	p := testProxy(t, newLocalListener(t))
+	p.RouteJournal = journal
+	p.AddRoute(testFrontAddr, noopTarget{})
+	p.Namespace("team-a").SetScope(NamespaceScope{
+		Listeners: []string{testFrontAddr},
+		Suffixes:  []string{"example.com"},
+		Backends:  []string{"10.0.0.0/8"},
+	})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"namespace":"team-a","listener":%q,"kind":"sni","name":"r%d.example.com","addr":"10.0.0.1:443"}`, testFrontAddr, i)
+			rec := httptest.NewRecorder()
+			p.AdminHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/routes", strings.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Errorf("adding route %d: %d %s", i, rec.Code, rec.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	entries, err := readJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != n {
+		t.Errorf("journal has %d routes; want %d", len(entries), n)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+type canonicalizerKey struct{}
+
+// canonicalizer is the name canonicalization that routes are matched
+// with.
+type canonicalizer struct {
+	fn       func(name string) string // nil to match raw names
+	standard bool                     // fn is CanonicalName
+}
+
+// matchContext returns the context routes are matched with, carrying
+// p's name canonicalization settings.
+func (p *Proxy) matchContext() context.Context {
+	c := canonicalizer{fn: p.CanonicalizeName}
+	switch {
+	case p.RawNames:
+		c.fn = nil
+	case c.fn == nil:
+		c = canonicalizer{CanonicalName, true}
+	}
+	return context.WithValue(context.Background(), canonicalizerKey{}, c)
+}
+
+// canonicalName canonicalizes name as configured in ctx. Names are
+// returned unchanged if ctx doesn't specify a canonicalization.
+func canonicalName(ctx context.Context, name string) string {
+	if c, _ := ctx.Value(canonicalizerKey{}).(canonicalizer); c.fn != nil && name != "" {
+		return c.fn(name)
+	}
+	return name
+}
+
+// standardNames reports whether ctx canonicalizes names with
+// CanonicalName.
+func standardNames(ctx context.Context) bool {
+	c, _ := ctx.Value(canonicalizerKey{}).(canonicalizer)
+	return c.standard
+}
+
+// idnaProfile converts names to their ASCII form for CanonicalName.
+// Unlike idna.Lookup, it allows names that aren't valid host names,
+// such as ones with underscores, since SNI and Host values are
+// matched rather than resolved.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false))
+
+// CanonicalName returns the canonical form of a DNS name, as used for
+// route matching by default: a trailing dot is removed, and the name
+// is mapped for lookup as IDNA specifies, which lowercases it and
+// converts labels containing non-ASCII characters to their "xn--"
+// (punycode) form. Names that IDNA rejects are just lowercased.
+func CanonicalName(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if isASCII(name) {
+		return strings.ToLower(name)
+	}
+	if a, err := idnaProfile.ToASCII(name); err == nil {
+		return a
+	}
+	return strings.ToLower(name)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"foo.com", "foo.com"},
+		{"Foo.COM", "foo.com"},
+		{"foo.com.", "foo.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"MÜNCHEN.de", "xn--mnchen-3ya.de"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{"例え.jp", "xn--r8jz45g.jp"},
+		{"Straße.de", "xn--strae-oqa.de"},
+		{"ＥＸＡＭＰＬＥ.com", "example.com"},
+		{"_acme.bücher.example", "_acme.xn--bcher-kva.example"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := CanonicalName(tt.in); got != tt.want {
+			t.Errorf("CanonicalName(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMatchCanonicalNames(t *testing.T) {
+	hello := func(name string) *bufio.Reader {
+		return bufio.NewReader(strings.NewReader(clientHelloRecord(t, name)))
+	}
+	m := sniMatch{equals("Bücher.example."), noopTarget{}}
+
+	p := &Proxy{}
+	target, name := m.match(p.matchContext(), hello("BÜCHER.example"))
+	if target == nil || name != "xn--bcher-kva.example" {
+		t.Errorf("default: got (%v, %q); want match of xn--bcher-kva.example", target, name)
+	}
+
+	p = &Proxy{RawNames: true}
+	if target, name := m.match(p.matchContext(), hello("BÜCHER.example")); target != nil {
+		t.Errorf("RawNames: matched %q; want no match", name)
+	}
+
+	p = &Proxy{CanonicalizeName: func(s string) string {
+		return strings.TrimPrefix(CanonicalName(s), "www.")
+	}}
+	m = sniMatch{equals("foo.com"), noopTarget{}}
+	if target, name := m.match(p.matchContext(), hello("WWW.foo.com")); target == nil || name != "foo.com" {
+		t.Errorf("custom: got (%v, %q); want match of foo.com", target, name)
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// A Namespace groups the routes managed by one tenant of a shared
+// Proxy, such as one team of an organization-wide SNI router. Routes
+// added through a Namespace count against its quota, are reported in
+// its stats, and can only be removed through it (or directly on the
+// Proxy by its operator).
+//
+// Namespaces are created by Proxy.Namespace.
+type Namespace struct {
+	name string
+	p    *Proxy
+
+	mu     sync.Mutex
+	quota  NamespaceQuota
+	scope  NamespaceScope
+	routes map[uuid.UUID]string // route id => ipPort
+	active int                  // connections being handled by the namespace's targets
+	stats  NamespaceStats
+}
+
+// NamespaceQuota limits what a Namespace may use. Zero values mean
+// no limit.
+type NamespaceQuota struct {
+	MaxRoutes int `json:"maxRoutes,omitempty"` // routes the namespace may have at once
+	MaxConns  int `json:"maxConns,omitempty"`  // connections its routes may handle concurrently
+}
+
+// NamespaceScope limits which routes a Namespace may add, so that a
+// tenant can't take over another's listeners or names, or reach
+// backends it shouldn't. An empty field allows nothing, so a
+// namespace can't add routes until its scope is set.
+type NamespaceScope struct {
+	// Listeners lists the listeners, by the ipPort they were added
+	// with, that the namespace may add routes to.
+	Listeners []string `json:"listeners,omitempty"`
+
+	// Suffixes lists the names the namespace's routes may match. A
+	// suffix allows itself and the names below it, so
+	// "team.example.com" allows "team.example.com" and
+	// "api.team.example.com" but not "otherteam.example.com".
+	Suffixes []string `json:"suffixes,omitempty"`
+
+	// Backends lists the addresses the namespace's DialProxy
+	// targets may dial, each either a CIDR such as "10.1.0.0/16",
+	// allowing any port on the IP addresses in it, or a host:port
+	// such as "db.internal:5432", whose port may be "*" to allow
+	// any port. DialProxies with a PortOffset or PortFunc dial
+	// varying ports, so need a CIDR or a "*" port.
+	Backends []string `json:"backends,omitempty"`
+}
+
+// NamespaceStats describes a Namespace's usage.
+type NamespaceStats struct {
+	Routes        int   `json:"routes"`
+	ActiveConns   int   `json:"activeConns"`
+	TotalConns    int64 `json:"totalConns"`
+	RejectedConns int64 `json:"rejectedConns"` // refused because of MaxConns
+}
+
+// Namespace returns the namespace called name, creating it if it
+// doesn't exist yet.
+//
+// A new namespace's scope is empty, so it can't add routes until the
+// operator calls SetScope.
+func (p *Proxy) Namespace(name string) *Namespace {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.namespaces == nil {
+		p.namespaces = make(map[string]*Namespace)
+	}
+	ns := p.namespaces[name]
+	if ns == nil {
+		ns = &Namespace{name: name, p: p, routes: make(map[uuid.UUID]string)}
+		p.namespaces[name] = ns
+	}
+	return ns
+}
+
+// lookupNamespace returns the namespace called name, or nil if it
+// doesn't exist.
+func (p *Proxy) lookupNamespace(name string) *Namespace {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.namespaces[name]
+}
+
+// namespaceList returns p's namespaces, sorted by name.
+func (p *Proxy) namespaceList() []*Namespace {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	nss := make([]*Namespace, 0, len(p.namespaces))
+	for _, ns := range p.namespaces {
+		nss = append(nss, ns)
+	}
+	sort.Slice(nss, func(i, j int) bool { return nss[i].name < nss[j].name })
+	return nss
+}
+
+// routeNamespace returns the name of the namespace owning routeId, or
+// the empty string.
+func (p *Proxy) routeNamespace(routeId uuid.UUID) string {
+	for _, ns := range p.namespaceList() {
+		if ns.owns(routeId) {
+			return ns.name
+		}
+	}
+	return ""
+}
+
+// releaseRoute forgets routeId in whichever namespace owns it.
+func (p *Proxy) releaseRoute(routeId uuid.UUID) {
+	for _, ns := range p.namespaceList() {
+		ns.mu.Lock()
+		delete(ns.routes, routeId)
+		ns.mu.Unlock()
+	}
+}
+
+// Name returns the namespace's name.
+func (ns *Namespace) Name() string { return ns.name }
+
+// SetQuota sets the namespace's quota. Lowering a quota below the
+// current usage doesn't remove routes or close connections, but
+// prevents new ones.
+func (ns *Namespace) SetQuota(q NamespaceQuota) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.quota = q
+}
+
+// SetScope sets which listeners, names and backends the namespace's
+// routes may use. Narrowing the scope doesn't remove existing routes.
+func (ns *Namespace) SetScope(s NamespaceScope) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.scope = s
+}
+
+// Scope returns the namespace's scope.
+func (ns *Namespace) Scope() NamespaceScope {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.scope
+}
+
+// Quota returns the namespace's quota.
+func (ns *Namespace) Quota() NamespaceQuota {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.quota
+}
+
+// Stats returns the namespace's current usage.
+func (ns *Namespace) Stats() NamespaceStats {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	st := ns.stats
+	st.Routes = len(ns.routes)
+	st.ActiveConns = ns.active
+	return st
+}
+
+// RouteIds returns the ids of the namespace's routes, keyed by
+// route id with the listener each is on as the value.
+func (ns *Namespace) RouteIds() map[uuid.UUID]string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ids := make(map[uuid.UUID]string, len(ns.routes))
+	for id, ipPort := range ns.routes {
+		ids[id] = ipPort
+	}
+	return ids
+}
+
+// AddSNIRoute is like Proxy.AddSNIRoute, but the route belongs to
+// the namespace. It fails if the namespace's route quota is used up,
+// if the route is outside the namespace's scope, or if another
+// namespace or the operator already routes sni on ipPort.
+func (ns *Namespace) AddSNIRoute(ipPort, sni string, dest Target) (uuid.UUID, error) {
+	return ns.addSNIRoute(ipPort, sni, dest, uuid.New())
+}
+
+func (ns *Namespace) addSNIRoute(ipPort, sni string, dest Target, routeId uuid.UUID) (uuid.UUID, error) {
+	return ns.addRoute(ipPort, sni, dest, func() uuid.UUID {
+		return ns.p.addSNIRoute(ipPort, sni, ns.wrap(dest), routeId)
+	})
+}
+
+// AddHTTPHostRoute is like Proxy.AddHTTPHostRoute, but the route
+// belongs to the namespace. It fails for the same reasons as
+// AddSNIRoute.
+func (ns *Namespace) AddHTTPHostRoute(ipPort, httpHost string, dest Target) (uuid.UUID, error) {
+	return ns.addHTTPHostRoute(ipPort, httpHost, dest, uuid.New())
+}
+
+func (ns *Namespace) addHTTPHostRoute(ipPort, httpHost string, dest Target, routeId uuid.UUID) (uuid.UUID, error) {
+	return ns.addRoute(ipPort, httpHost, dest, func() uuid.UUID {
+		return ns.p.addHTTPHostRoute(ipPort, httpHost, ns.wrap(dest), routeId)
+	})
+}
+
+// RemoveRoute removes the namespace's route routeId. It fails if the
+// route doesn't belong to the namespace.
+func (ns *Namespace) RemoveRoute(routeId uuid.UUID) error {
+	ns.mu.Lock()
+	ipPort, ok := ns.routes[routeId]
+	ns.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("tcpproxy: route %v not in namespace %q", routeId, ns.name)
+	}
+	ns.p.RemoveRouteById(ipPort, routeId)
+	return nil
+}
+
+func (ns *Namespace) owns(routeId uuid.UUID) bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	_, ok := ns.routes[routeId]
+	return ok
+}
+
+// quotaError is returned when adding a route would exceed a quota,
+// or is outside a namespace's scope.
+type quotaError string
+
+func (e quotaError) Error() string { return string(e) }
+
+// addRoute checks the route quota and scope for a route matching
+// name and proxying to dest, and records the route added by add. The namespace stays
+// locked meanwhile, so concurrent adds can't overshoot the quota.
+func (ns *Namespace) addRoute(ipPort, name string, dest Target, add func() uuid.UUID) (uuid.UUID, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if max := ns.quota.MaxRoutes; max > 0 && len(ns.routes) >= max {
+		return uuid.Nil, quotaError(fmt.Sprintf("tcpproxy: namespace %q is at its quota of %d routes", ns.name, max))
+	}
+	if err := ns.checkScope(ipPort, name, dest); err != nil {
+		return uuid.Nil, err
+	}
+	if id, ok := ns.p.routeForName(ipPort, name); ok {
+		if _, own := ns.routes[id]; !own {
+			return uuid.Nil, quotaError(fmt.Sprintf("tcpproxy: %q is already routed on %s outside namespace %q", name, ipPort, ns.name))
+		}
+	}
+	id := add()
+	ns.routes[id] = ipPort
+	return id, nil
+}
+
+// checkScope reports whether a route on ipPort matching name and
+// proxying to dest is within the namespace's scope. Targets other
+// than DialProxies, which can only be added through the Go API, may
+// proxy anywhere. ns.mu must be held.
+func (ns *Namespace) checkScope(ipPort, name string, dest Target) error {
+	ok := false
+	for _, l := range ns.scope.Listeners {
+		ok = ok || l == ipPort
+	}
+	if !ok {
+		return quotaError(fmt.Sprintf("tcpproxy: listener %s is outside namespace %q", ipPort, ns.name))
+	}
+
+	name = CanonicalName(name)
+	ok = false
+	for _, s := range ns.scope.Suffixes {
+		s = CanonicalName(strings.TrimPrefix(s, "."))
+		ok = ok || name == s || strings.HasSuffix(name, "."+s)
+	}
+	if !ok {
+		return quotaError(fmt.Sprintf("tcpproxy: name %q is outside namespace %q", name, ns.name))
+	}
+
+	if len(ns.scope.Backends) == 0 {
+		return quotaError(fmt.Sprintf("tcpproxy: namespace %q may not route to any backend", ns.name))
+	}
+	var err error
+	dialProxies(dest, func(dp *DialProxy) {
+		if err == nil && !backendAllowed(ns.scope.Backends, dp) {
+			err = quotaError(fmt.Sprintf("tcpproxy: backend %s is outside namespace %q", dp.Addr, ns.name))
+		}
+	})
+	return err
+}
+
+// backendAllowed reports whether one of the NamespaceScope.Backends
+// patterns in allow permits the addresses dp dials.
+func backendAllowed(allow []string, dp *DialProxy) bool {
+	host, port, err := net.SplitHostPort(dp.Addr)
+	if err != nil {
+		host, port = dp.Addr, ""
+	}
+	if dp.translatesPort() {
+		port = ""
+	}
+	ip := net.ParseIP(host)
+	for _, a := range allow {
+		if _, n, err := net.ParseCIDR(a); err == nil {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		ah, ap, err := net.SplitHostPort(a)
+		if err != nil || (ap != "*" && (port == "" || ap != port)) {
+			continue
+		}
+		if aip := net.ParseIP(ah); aip != nil && ip != nil {
+			if aip.Equal(ip) {
+				return true
+			}
+		} else if strings.EqualFold(strings.TrimSuffix(ah, "."), strings.TrimSuffix(host, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns dest wrapped so that its connections count against
+// the namespace.
+func (ns *Namespace) wrap(dest Target) Target {
+	return &namespaceTarget{ns: ns, Target: dest}
+}
+
+// namespaceTarget is a Target that accounts its connections to a
+// Namespace and enforces its MaxConns quota.
+type namespaceTarget struct {
+	ns *Namespace
+	Target
+}
+
+func (t *namespaceTarget) HandleConn(c net.Conn) {
+	ns := t.ns
+	ns.mu.Lock()
+	if max := ns.quota.MaxConns; max > 0 && ns.active >= max {
+		ns.stats.RejectedConns++
+		ns.mu.Unlock()
+		log.Printf("tcpproxy: for incoming conn %v, namespace %q is at its quota of %d connections", c.RemoteAddr(), ns.name, max)
+		shed(c)
+		return
+	}
+	ns.active++
+	ns.stats.TotalConns++
+	ns.mu.Unlock()
+
+	defer func() {
+		ns.mu.Lock()
+		ns.active--
+		ns.mu.Unlock()
+	}()
+	t.Target.HandleConn(c)
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNamespaceRoutes(t *testing.T) {
+	var p Proxy
+	team := p.Namespace("team-a")
+	if p.Namespace("team-a") != team {
+		t.Fatal("Namespace returned a different namespace for the same name")
+	}
+	team.SetQuota(NamespaceQuota{MaxRoutes: 2})
+	team.SetScope(NamespaceScope{
+		Listeners: []string{":443", ":80"},
+		Suffixes:  []string{"example.com"},
+		Backends:  []string{"10.0.0.0/8"},
+	})
+
+	id1, err := team.AddSNIRoute(":443", "a.example.com", To("10.0.0.1:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.AddHTTPHostRoute(":80", "a.example.com", To("10.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.AddSNIRoute(":443", "b.example.com", noopTarget{}); err == nil {
+		t.Error("added route beyond MaxRoutes")
+	}
+
+	other := p.Namespace("team-b")
+	if err := other.RemoveRoute(id1); err == nil {
+		t.Error("removed another namespace's route")
+	}
+
+	d := p.DumpConfig()
+	if len(d.Namespaces) != 2 || d.Namespaces[0].Name != "team-a" || d.Namespaces[0].Stats.Routes != 2 {
+		t.Errorf("dumped namespaces = %+v", d.Namespaces)
+	}
+	for _, ld := range d.Listeners {
+		for _, r := range ld.Routes {
+			if r.Id == id1 && r.Match != "" && (r.Namespace != "team-a" || r.Target == nil || r.Target.Addr != "10.0.0.1:443") {
+				t.Errorf("dumped route = %+v, target %+v", r, r.Target)
+			}
+		}
+	}
+
+	if err := team.RemoveRoute(id1); err != nil {
+		t.Fatal(err)
+	}
+	if n := team.Stats().Routes; n != 1 {
+		t.Errorf("Routes after removal = %d; want 1", n)
+	}
+	if len(p.configFor(":443").Routes()) != 0 {
+		t.Error("route was not removed from the listener")
+	}
+}
+
+func TestNamespaceScope(t *testing.T) {
+	var p Proxy
+	opId := p.AddSNIRoute(":443", "ops.example.com", noopTarget{})
+	team := p.Namespace("team-a")
+	team.SetScope(NamespaceScope{
+		Listeners: []string{":443"},
+		Suffixes:  []string{"team-a.example.com"},
+		Backends:  []string{"10.1.0.0/16", "db.internal:5432", "web.internal:*"},
+	})
+
+	tests := []struct {
+		ipPort, name string
+		dest         Target
+		ok           bool
+	}{
+		{":443", "team-a.example.com", noopTarget{}, true},
+		{":443", "API.team-a.example.com.", noopTarget{}, true},
+		{":443", "xteam-a.example.com", noopTarget{}, false},
+		{":443", "example.com", noopTarget{}, false},
+		{":8443", "b.team-a.example.com", noopTarget{}, false},
+		{":443", "c.team-a.example.com", To("10.1.2.3:443"), true},
+		{":443", "c.team-a.example.com", To("10.2.0.1:443"), false},
+		{":443", "c.team-a.example.com", To("db.internal:5432"), true},
+		{":443", "c.team-a.example.com", To("db.internal:22"), false},
+		{":443", "c.team-a.example.com", To("web.internal:8080"), true},
+		{":443", "c.team-a.example.com", &DialProxy{Addr: "db.internal:5432", PortOffset: 1}, false},
+		{":443", "c.team-a.example.com", &FaultTarget{Target: To("10.2.0.1:443")}, false},
+	}
+	for _, tt := range tests {
+		_, err := team.AddSNIRoute(tt.ipPort, tt.name, tt.dest)
+		if (err == nil) != tt.ok {
+			t.Errorf("AddSNIRoute(%q, %q, %+v) = %v; want ok=%v", tt.ipPort, tt.name, tt.dest, err, tt.ok)
+		}
+	}
+
+	// An empty scope allows nothing.
+	other := p.Namespace("team-b")
+	if _, err := other.AddSNIRoute(":443", "b.example.com", noopTarget{}); err == nil {
+		t.Error("namespace with an empty scope added a route")
+	}
+	other.SetScope(NamespaceScope{Listeners: []string{":443"}, Suffixes: []string{"example.com"}, Backends: []string{"10.2.0.0/16"}})
+
+	// Names already routed elsewhere can't be claimed, but a
+	// namespace may add to its own names.
+	if _, err := other.AddSNIRoute(":443", "ops.example.com", noopTarget{}); err == nil {
+		t.Error("namespace claimed an operator route's name")
+	}
+	if _, err := other.AddSNIRoute(":443", "team-a.example.com", noopTarget{}); err == nil {
+		t.Error("namespace claimed another namespace's name")
+	}
+	if _, err := team.AddSNIRoute(":443", "team-a.example.com", noopTarget{}); err != nil {
+		t.Errorf("re-adding own name: %v", err)
+	}
+	if _, err := other.AddSNIRoute(":443", "b.example.com", noopTarget{}); err != nil {
+		t.Errorf("scoped namespace: %v", err)
+	}
+	p.RemoveRouteById(":443", opId)
+	if _, err := other.AddSNIRoute(":443", "ops.example.com", noopTarget{}); err != nil {
+		t.Errorf("adding a freed name: %v", err)
+	}
+}
+
+func TestNamespaceMaxConns(t *testing.T) {
+	var p Proxy
+	ns := p.Namespace("team-a")
+	ns.SetQuota(NamespaceQuota{MaxConns: 1})
+
+	held := blockingTarget{make(chan net.Conn, 1)}
+	target := ns.wrap(held)
+
+	client, c := net.Pipe()
+	go target.HandleConn(c)
+	<-held.got
+
+	rejectedClient, rejected := net.Pipe()
+	go target.HandleConn(rejected)
+	if _, err := rejectedClient.Read(make([]byte, 1)); err == nil {
+		t.Error("conn beyond MaxConns was not closed")
+	}
+
+	st := ns.Stats()
+	if st.ActiveConns != 1 || st.TotalConns != 1 || st.RejectedConns != 1 {
+		t.Errorf("Stats = %+v; want 1 active, 1 total, 1 rejected", st)
+	}
+	client.Close()
+}
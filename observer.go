@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// An Observer is notified about the traffic of connections matched
+// by a route, for example to meter per-tenant usage. Byte counts are
+// as seen on the client connection: in is bytes received from the
+// client, including those read while matching routes, and out is
+// bytes sent to the client.
+//
+// Observer methods are called from the goroutines handling the
+// connection and must be safe for concurrent use.
+type Observer interface {
+	// OnConnOpen is called when conn is handed to the route's
+	// target.
+	OnConnOpen(conn net.Conn, routeId uuid.UUID)
+
+	// OnBytes is called each time bytes are received from or sent
+	// to the client. in and out are the bytes transferred by that
+	// call, not running totals.
+	OnBytes(conn net.Conn, routeId uuid.UUID, in, out int64)
+
+	// OnConnClose is called once, when the target closes conn,
+	// with the total bytes transferred over its lifetime.
+	OnConnClose(conn net.Conn, routeId uuid.UUID, in, out int64)
+}
+
+// SetRouteObserver registers obs to be notified about connections
+// matched by the route routeId on the ipPort listener. Observing a
+// connection disables the kernel splice optimization for it.
+func (p *Proxy) SetRouteObserver(ipPort string, routeId uuid.UUID, obs Observer) {
+	cfg := p.configFor(ipPort)
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if cfg.observers == nil {
+		cfg.observers = make(map[uuid.UUID]Observer)
+	}
+	cfg.observers[routeId] = obs
+}
+
+func (c *config) observer(routeId uuid.UUID) Observer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.observers[routeId]
+}
+
+// observe wraps c so its traffic is reported to obs. peeked is the
+// number of bytes already read from c while matching routes.
+func observe(c net.Conn, routeId uuid.UUID, obs Observer, peeked int) net.Conn {
+	oc := &observedConn{
+		Conn:    c,
+		routeId: routeId,
+		obs:     obs,
+		in:      int64(peeked),
+	}
+	obs.OnConnOpen(c, routeId)
+	if peeked > 0 {
+		obs.OnBytes(c, routeId, int64(peeked), 0)
+	}
+	return oc
+}
+
+// observedConn is a net.Conn that reports its traffic to an Observer.
+type observedConn struct {
+	net.Conn
+	routeId uuid.UUID
+	obs     Observer
+
+	in, out   int64 // updated atomically
+	closeOnce sync.Once
+}
+
+func (c *observedConn) netConn() net.Conn { return c.Conn }
+
+func (c *observedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&c.in, int64(n))
+		c.obs.OnBytes(c.Conn, c.routeId, int64(n), 0)
+	}
+	return n, err
+}
+
+func (c *observedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		atomic.AddInt64(&c.out, int64(n))
+		c.obs.OnBytes(c.Conn, c.routeId, 0, int64(n))
+	}
+	return n, err
+}
+
+func (c *observedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.obs.OnConnClose(c.Conn, c.routeId, atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out))
+	})
+	return err
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type countingObserver struct {
+	mu        sync.Mutex
+	opened    int
+	bytesIn   int64
+	bytesOut  int64
+	closedIn  int64
+	closedOut int64
+	routeIds  map[uuid.UUID]bool
+	closed    chan struct{}
+}
+
+func (o *countingObserver) OnConnOpen(_ net.Conn, id uuid.UUID) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.opened++
+	o.routeIds[id] = true
+}
+
+func (o *countingObserver) OnBytes(_ net.Conn, id uuid.UUID, in, out int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.bytesIn += in
+	o.bytesOut += out
+	o.routeIds[id] = true
+}
+
+func (o *countingObserver) OnConnClose(_ net.Conn, id uuid.UUID, in, out int64) {
+	o.mu.Lock()
+	o.closedIn, o.closedOut = in, out
+	o.routeIds[id] = true
+	o.mu.Unlock()
+	close(o.closed)
+}
+
+func TestProxyRouteObserver(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	obs := &countingObserver{routeIds: map[uuid.UUID]bool{}, closed: make(chan struct{})}
+	p := testProxy(t, front)
+	id := p.AddHTTPHostRoute(testFrontAddr, "foo.com", To(back.Addr().String()))
+	p.SetRouteObserver(testFrontAddr, id, obs)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const req = "GET / HTTP/1.1\r\nHost: foo.com\r\n\r\n"
+	const resp = "HTTP/1.1 204 No Content\r\n\r\n"
+	io.WriteString(toFront, req)
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(req))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fromProxy, resp)
+	fromProxy.Close()
+	if _, err := ioutil.ReadAll(toFront); err != nil {
+		t.Fatal(err)
+	}
+	toFront.Close()
+	<-obs.closed
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if obs.opened != 1 {
+		t.Errorf("OnConnOpen called %d times; want 1", obs.opened)
+	}
+	if obs.closedIn != int64(len(req)) || obs.closedOut != int64(len(resp)) {
+		t.Errorf("OnConnClose totals = %d in, %d out; want %d, %d", obs.closedIn, obs.closedOut, len(req), len(resp))
+	}
+	if obs.bytesIn != obs.closedIn || obs.bytesOut != obs.closedOut {
+		t.Errorf("OnBytes sums = %d in, %d out; want close totals", obs.bytesIn, obs.bytesOut)
+	}
+	if len(obs.routeIds) != 1 || !obs.routeIds[id] {
+		t.Errorf("observed route ids %v; want only %v", obs.routeIds, id)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// A Peeker reports whether a connection matches some criteria by
+// examining its first bytes. It must only Peek at br, not consume
+// bytes from it.
+type Peeker func(br *bufio.Reader) bool
+
+// PeekMatcher returns a Peeker that passes the first n bytes of the
+// connection to match. Connections that end before sending n bytes
+// don't match.
+//
+// Waiting for n bytes blocks until the client sends them, so n
+// should not exceed what the protocol's first message always
+// contains.
+func PeekMatcher(n int, match func(b []byte) bool) Peeker {
+	return func(br *bufio.Reader) bool {
+		b, err := br.Peek(n)
+		return err == nil && match(b)
+	}
+}
+
+// AddPeekRoute appends a route to the ipPort listener that routes to
+// dest if peek accepts the connection's first bytes. If it doesn't
+// match, rule processing continues for any additional routes on
+// ipPort.
+//
+// The ipPort is any valid net.Listen TCP address.
+func (p *Proxy) AddPeekRoute(ipPort string, peek Peeker, dest Target) uuid.UUID {
+	return p.addRoute(ipPort, peekMatch{peek, dest, nil})
+}
+
+// AddPrefixMatchRoute appends a route to the ipPort listener that
+// routes to dest if the connection starts with prefix, such as the
+// magic bytes of a binary protocol. Bytes are examined one at a time,
+// so connections that diverge from prefix are rejected without
+// waiting for more input. If it doesn't match, rule processing
+// continues for any additional routes on ipPort.
+//
+// The ipPort is any valid net.Listen TCP address.
+func (p *Proxy) AddPrefixMatchRoute(ipPort string, prefix []byte, dest Target) uuid.UUID {
+	prefix = append([]byte(nil), prefix...)
+	peek := func(br *bufio.Reader) bool { return hasPrefix(br, prefix) }
+	return p.addRoute(ipPort, peekMatch{peek, dest, prefix})
+}
+
+type peekMatch struct {
+	peek   Peeker
+	target Target
+	prefix []byte // for AddPrefixMatchRoute, for display
+}
+
+func (m peekMatch) match(_ context.Context, br *bufio.Reader) (Target, string) {
+	if m.peek(br) {
+		return m.target, ""
+	}
+	return nil, ""
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestPeekRoutes(t *testing.T) {
+	var p Proxy
+	magic := make(connTarget, 1)
+	versioned := make(connTarget, 1)
+	p.AddPrefixMatchRoute(testFrontAddr, []byte("\x89MAGIC"), magic)
+	p.AddPeekRoute(testFrontAddr, PeekMatcher(4, func(b []byte) bool {
+		return binary.BigEndian.Uint16(b[2:]) == 7
+	}), versioned)
+	routes := p.configFor(testFrontAddr).Routes()
+
+	tests := []struct {
+		in   string
+		want Target
+	}{
+		{"\x89MAGIC and more", magic},
+		{"\x89MAG", nil},
+		{"\x00\x01\x00\x07", versioned},
+		{"\x00\x01\x00\x08", nil},
+		{"\x00\x01", nil},
+	}
+	for _, tt := range tests {
+		var got Target
+		for _, r := range routes {
+			br := bufio.NewReader(strings.NewReader(tt.in))
+			if got, _ = r.Route.match(context.Background(), br); got != nil {
+				if br.Buffered() == 0 {
+					t.Errorf("%q: matcher consumed its input", tt.in)
+				}
+				break
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%q matched %v; want %v", tt.in, got, tt.want)
+		}
+	}
+
+	if d := describeRoute(routes[0].Route); d != `prefix "\x89MAGIC"` {
+		t.Errorf("describeRoute = %s", d)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// connPool keeps a small number of backend connections dialed ahead
+// of time. A connection taken from the pool is owned by the caller;
+// the pool never hands out the same connection twice. Connections
+// unused for maxAge are closed.
+type connPool struct {
+	dial   func() (net.Conn, error)
+	size   int
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	idle    []warmConn  // oldest first
+	dialing int         // number of dials in flight
+	sweep   *time.Timer // pending sweepExpired, if any
+	closed  bool        // set by close; the pool stays empty
+}
+
+// poolMu guards the pool field of every DialProxy. It is global
+// rather than per DialProxy so that DialProxy values hold no locks.
+var poolMu sync.Mutex
+
+type warmConn struct {
+	net.Conn
+	dialed time.Time
+}
+
+// connPool returns dp's pool of warm connections, or nil if
+// dp.WarmConns is zero or dp translates ports.
+func (dp *DialProxy) connPool() *connPool {
+	if dp.WarmConns <= 0 || dp.translatesPort() {
+		return nil
+	}
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	if dp.pool == nil {
+		dp.pool = &connPool{
+			dial:   dp.dial,
+			size:   dp.WarmConns,
+			maxAge: dp.warmConnMaxAge(),
+		}
+	}
+	return dp.pool
+}
+
+// closeConnPool closes dp's warm connections, if it has any, and
+// stops it dialing more. The pool is detached from dp, so dp gets a
+// new one if it's added to a route again.
+func (dp *DialProxy) closeConnPool() {
+	poolMu.Lock()
+	pool := dp.pool
+	dp.pool = nil
+	poolMu.Unlock()
+	if pool != nil {
+		pool.close()
+	}
+}
+
+// closeUnusedPools closes the warm connection pools of the
+// DialProxies among targets, which were removed from p's routes,
+// unless they're still the target of another route.
+func (p *Proxy) closeUnusedPools(targets []Target) {
+	var dps []*DialProxy
+	for _, t := range targets {
+		dialProxies(t, func(dp *DialProxy) {
+			if dp.WarmConns > 0 {
+				dps = append(dps, dp)
+			}
+		})
+	}
+	if len(dps) == 0 {
+		return
+	}
+
+	inUse := make(map[*DialProxy]bool)
+	markInUse := func(dp *DialProxy) { inUse[dp] = true }
+	p.mu.Lock()
+	cfgs := make([]*config, 0, len(p.configs))
+	for _, cfg := range p.configs {
+		cfgs = append(cfgs, cfg)
+	}
+	p.mu.Unlock()
+	for _, cfg := range cfgs {
+		for _, r := range cfg.Routes() {
+			dialProxies(routeTarget(r.Route), markInUse)
+		}
+		dialProxies(cfg.defaultTarget, markInUse)
+	}
+	for _, dp := range dps {
+		if !inUse[dp] {
+			dp.closeConnPool()
+		}
+	}
+}
+
+// dialProxies calls fn with each DialProxy that t proxies to,
+// looking through the Targets that wrap others: Namespaces,
+// TargetGroups, FaultTargets, RecordTargets and ScheduledTargets.
+func dialProxies(t Target, fn func(*DialProxy)) {
+	walkDialProxies(t, fn, make(map[*TargetGroup]bool))
+}
+
+// walkDialProxies implements dialProxies. Groups already in seen are
+// skipped, in case a group is (indirectly) its own member.
+func walkDialProxies(t Target, fn func(*DialProxy), seen map[*TargetGroup]bool) {
+	switch t := t.(type) {
+	case *DialProxy:
+		fn(t)
+	case *namespaceTarget:
+		walkDialProxies(t.Target, fn, seen)
+	case *TargetGroup:
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		for _, m := range t.Members() {
+			walkDialProxies(m.Target, fn, seen)
+		}
+	case *FaultTarget:
+		walkDialProxies(t.Target, fn, seen)
+	case *RecordTarget:
+		walkDialProxies(t.Target, fn, seen)
+	case *ScheduledTarget:
+		walkDialProxies(t.During, fn, seen)
+		walkDialProxies(t.Otherwise, fn, seen)
+	}
+}
+
+// get returns a warm connection, or nil if none is ready. Either
+// way, it starts dialing replacements to refill the pool.
+func (p *connPool) get() net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+
+	var c net.Conn
+	for c == nil && len(p.idle) > 0 {
+		wc := p.idle[0]
+		p.idle = p.idle[1:]
+		if time.Since(wc.dialed) < p.maxAge {
+			c = wc.Conn
+		} else {
+			goCloseConn(wc.Conn)
+		}
+	}
+	p.fillLocked()
+	return c
+}
+
+// fillLocked starts enough dials to bring the pool back up to size.
+// p.mu must be held.
+func (p *connPool) fillLocked() {
+	for len(p.idle)+p.dialing < p.size {
+		p.dialing++
+		go p.dialOne()
+	}
+}
+
+// dialOne dials a single warm connection. Failed dials are not
+// retried until the next call to get, so an unreachable backend
+// doesn't cause a dial loop.
+func (p *connPool) dialOne() {
+	c, err := func() (c net.Conn, err error) {
+		defer recoverBackground("dialing warm connection", &err)
+		return p.dial()
+	}()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if err != nil {
+		return
+	}
+	if p.closed {
+		goCloseConn(c)
+		return
+	}
+	p.idle = append(p.idle, warmConn{c, time.Now()})
+	p.scheduleSweepLocked()
+}
+
+// scheduleSweepLocked arranges for sweepExpired to run when the
+// oldest idle connection expires. p.mu must be held.
+func (p *connPool) scheduleSweepLocked() {
+	if p.sweep != nil || len(p.idle) == 0 {
+		return
+	}
+	p.sweep = time.AfterFunc(time.Until(p.idle[0].dialed.Add(p.maxAge)), p.sweepExpired)
+}
+
+// sweepExpired closes the idle connections older than maxAge. They
+// aren't replaced until the next call to get.
+func (p *connPool) sweepExpired() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep = nil
+	for len(p.idle) > 0 && time.Since(p.idle[0].dialed) >= p.maxAge {
+		goCloseConn(p.idle[0].Conn)
+		p.idle = p.idle[1:]
+	}
+	p.scheduleSweepLocked()
+}
+
+// close closes the idle connections and any dialed later, and makes
+// get always return nil.
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.sweep != nil {
+		p.sweep.Stop()
+		p.sweep = nil
+	}
+	for _, wc := range p.idle {
+		goCloseConn(wc.Conn)
+	}
+	p.idle = nil
+}
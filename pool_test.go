@@ -0,0 +1,224 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnPoolWarmConns(t *testing.T) {
+	dials := make(chan net.Conn, 10)
+	dp := &DialProxy{
+		Addr:      "backend:1",
+		WarmConns: 2,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, _ := net.Pipe()
+			dials <- c
+			return c, nil
+		},
+	}
+
+	pool := dp.connPool()
+	if c := pool.get(); c != nil {
+		t.Fatalf("get on empty pool = %v; want nil", c)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-dials:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pool dialed %d conns; want 2", i)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.mu.Lock()
+		n := len(pool.idle)
+		pool.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d idle conns; want 2", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if c := pool.get(); c == nil {
+		t.Fatal("get on warm pool = nil; want conn")
+	}
+	select {
+	case <-dials:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pool did not refill after get")
+	}
+}
+
+func TestConnPoolMaxAge(t *testing.T) {
+	dp := &DialProxy{
+		Addr:           "backend:1",
+		WarmConns:      1,
+		WarmConnMaxAge: time.Nanosecond,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, _ := net.Pipe()
+			return c, nil
+		},
+	}
+	pool := dp.connPool()
+	pool.mu.Lock()
+	c, _ := net.Pipe()
+	pool.idle = append(pool.idle, warmConn{c, time.Now().Add(-time.Second)})
+	pool.mu.Unlock()
+
+	if got := pool.get(); got != nil {
+		t.Fatalf("get returned expired conn %v", got)
+	}
+}
+
+func TestConnPoolSweepsExpired(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	dp := &DialProxy{
+		Addr:           "backend:1",
+		WarmConns:      1,
+		WarmConnMaxAge: 50 * time.Millisecond,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, backend := net.Pipe()
+			go func() {
+				backend.Read(make([]byte, 1))
+				closed <- struct{}{}
+			}()
+			return c, nil
+		},
+	}
+	dp.connPool().get()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expired warm conn was not closed")
+	}
+}
+
+func TestRemoveRouteClosesConnPool(t *testing.T) {
+	dials := make(chan net.Conn, 10)
+	dp := &DialProxy{
+		Addr:      "backend:1",
+		WarmConns: 1,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, backend := net.Pipe()
+			dials <- backend
+			return c, nil
+		},
+	}
+	var p Proxy
+	id1 := p.AddRoute(testFrontAddr, dp)
+	id2 := p.AddSNIRoute(":8443", "foo.com", dp)
+	pool := dp.connPool()
+	pool.get()
+	backend := <-dials
+
+	p.RemoveRouteById(testFrontAddr, id1)
+	pool.mu.Lock()
+	closed := pool.closed
+	pool.mu.Unlock()
+	if closed {
+		t.Fatal("pool closed while another route uses it")
+	}
+
+	p.RemoveRouteById(":8443", id2)
+	if c := pool.get(); c != nil {
+		t.Errorf("get on closed pool = %v; want nil", c)
+	}
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := backend.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("reading from warm conn's backend after removal: %v; want EOF", err)
+	}
+}
+
+func TestRemoveRouteLooksThroughWrappers(t *testing.T) {
+	dp := &DialProxy{
+		Addr:      "backend:1",
+		WarmConns: 1,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, backend := net.Pipe()
+			go backend.Close()
+			return c, nil
+		},
+	}
+	var g TargetGroup
+	g.Add(dp, 1)
+	var p Proxy
+	id1 := p.AddRoute(testFrontAddr, &g)
+	id2 := p.AddSNIRoute(":8443", "foo.com", &ScheduledTarget{
+		During:    noopTarget{},
+		Otherwise: &FaultTarget{Target: dp},
+	})
+	pool := dp.connPool()
+
+	p.RemoveRouteById(testFrontAddr, id1)
+	pool.mu.Lock()
+	closed := pool.closed
+	pool.mu.Unlock()
+	if closed {
+		t.Fatal("pool closed while a wrapped route target uses it")
+	}
+
+	p.RemoveRouteById(":8443", id2)
+	pool.mu.Lock()
+	closed = pool.closed
+	pool.mu.Unlock()
+	if !closed {
+		t.Fatal("pool of a DialProxy in a removed group wasn't closed")
+	}
+}
+
+func TestReaddedDialProxyGetsNewPool(t *testing.T) {
+	dials := make(chan net.Conn, 10)
+	dp := &DialProxy{
+		Addr:      "backend:1",
+		WarmConns: 1,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, backend := net.Pipe()
+			dials <- backend
+			return c, nil
+		},
+	}
+	var p Proxy
+	id := p.AddRoute(testFrontAddr, dp)
+	old := dp.connPool()
+	p.RemoveRouteById(testFrontAddr, id)
+
+	p.AddRoute(testFrontAddr, dp)
+	pool := dp.connPool()
+	if pool == old {
+		t.Fatal("re-added DialProxy kept its closed pool")
+	}
+	pool.get()
+	<-dials
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if c := pool.get(); c != nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("re-added DialProxy's pool never warmed a conn")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
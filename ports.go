@@ -0,0 +1,54 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// translatesPort reports whether dp picks its backend port per
+// connection.
+func (dp *DialProxy) translatesPort() bool {
+	return dp.PortOffset != 0 || dp.PortFunc != nil
+}
+
+// backendAddr returns the address to dial for src, applying dp's
+// PortOffset or PortFunc to the port src connected to.
+func (dp *DialProxy) backendAddr(src net.Conn) (string, error) {
+	host := dp.Addr
+	if h, _, err := net.SplitHostPort(dp.Addr); err == nil {
+		host = h
+	}
+	var local int
+	if a, ok := src.LocalAddr().(*net.TCPAddr); ok {
+		local = a.Port
+	}
+
+	var port int
+	switch {
+	case dp.PortFunc != nil:
+		port = dp.PortFunc(src, local)
+	case local == 0:
+		return "", fmt.Errorf("tcpproxy: can't translate port of non-TCP local address %v", src.LocalAddr())
+	default:
+		port = local + dp.PortOffset
+	}
+	if port <= 0 || port > 65535 {
+		return "", fmt.Errorf("tcpproxy: translated backend port %d out of range", port)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
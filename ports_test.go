@@ -0,0 +1,63 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// localAddrConn is a net.Conn with a fixed local address.
+type localAddrConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c localAddrConn) LocalAddr() net.Addr { return c.local }
+
+func TestDialProxyBackendAddr(t *testing.T) {
+	a, _ := net.Pipe()
+	src := &Conn{
+		HostName: "tenant2.example.com",
+		Conn:     localAddrConn{a, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}},
+	}
+	tenants := map[string]int{"tenant1.example.com": 1, "tenant2.example.com": 2}
+	tests := []struct {
+		dp   *DialProxy
+		want string
+	}{
+		{&DialProxy{Addr: "backend:80"}, "backend:80"},
+		{&DialProxy{Addr: "backend", PortOffset: 8000}, "backend:8443"},
+		{&DialProxy{Addr: "10.1.1.1:1", PortOffset: 8000}, "10.1.1.1:8443"},
+		{&DialProxy{Addr: "backend", PortFunc: func(src net.Conn, port int) int {
+			return 9000 + 100*tenants[src.(*Conn).HostName] + port%100
+		}}, "backend:9243"},
+		{&DialProxy{Addr: "backend", PortOffset: 65535}, ""},
+	}
+	for i, tt := range tests {
+		var dialed string
+		tt.dp.DialContext = func(_ context.Context, _, addr string) (net.Conn, error) {
+			dialed = addr
+			return nil, errors.New("not dialing in test")
+		}
+		tt.dp.OnDialError = func(net.Conn, error) {}
+		tt.dp.HandleConn(src)
+		if dialed != tt.want {
+			t.Errorf("%d. dialed %q; want %q", i, dialed, tt.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// preDialHint records the DialProxy of an exact-match SNI route, so
+// that the proxy can guess the backend before running the matchers.
+type preDialHint struct {
+	id uuid.UUID
+	dp *DialProxy
+}
+
+// addPreDialHint registers dp as the likely backend for sni, the
+// exact name matched by route id. Only the first route added for a
+// given name is used, and only if every route before it is also an
+// exact SNI route, so that a connection for sni is sure to be routed
+// to dp. Routes are only ever appended, so a hint stays valid until
+// its route is removed. Names are stored in their default canonical
+// form, so pre-dialing only applies to connections using the default
+// canonicalization.
+func (c *config) addPreDialHint(sni string, id uuid.UUID, dp *DialProxy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sni = CanonicalName(sni)
+	if !c.onlyExactBeforeLocked(sni, id) {
+		return
+	}
+	if c.preDialHints == nil {
+		c.preDialHints = make(map[string]preDialHint)
+	}
+	if _, ok := c.preDialHints[sni]; !ok {
+		c.preDialHints[sni] = preDialHint{id, dp}
+	}
+}
+
+// onlyExactBeforeLocked reports whether the routes before the SNI
+// route id can only match connections for names other than sni, so
+// that those for sni reach route id. That holds for exact SNI routes,
+// and for the ACME route unless sni is an ACME challenge name. c.mu
+// must be held.
+func (c *config) onlyExactBeforeLocked(sni string, id uuid.UUID) bool {
+	for _, r := range c.routes {
+		switch r.Route.(type) {
+		case sniMatch:
+			if r.Id == id {
+				return true
+			}
+			if _, exact := c.routeNames[r.Id]; exact {
+				continue
+			}
+		case *acmeMatch:
+			if !strings.HasSuffix(sni, ".acme.invalid") {
+				continue
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// startPreDial parses the SNI from br and, if an exact SNI route
+// exists for it, starts dialing that route's backend, resolving its
+// name with the DialProxy's Resolver or else r. It returns nil if
+// there is nothing to pre-dial.
+func (c *config) startPreDial(ctx context.Context, br *bufio.Reader, r *Resolver) *preDial {
+	c.mu.Lock()
+	hasHints := len(c.preDialHints) > 0
+	c.mu.Unlock()
+	if !hasHints {
+		return nil
+	}
+
+	sni := canonicalName(ctx, clientHelloServerName(br))
+	if sni == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	hint, ok := c.preDialHints[sni]
+	c.mu.Unlock()
+	if !ok || hint.dp.translatesPort() {
+		return nil
+	}
+
+	pd := &preDial{
+		dp:       hint.dp,
+		resolver: hint.dp.resolverFor(r),
+		done:     make(chan struct{}),
+	}
+	go pd.dial()
+	return pd
+}
+
+// preDial is a backend dial started before routing completed.
+type preDial struct {
+	dp       *DialProxy
+	resolver *Resolver
+	done     chan struct{} // closed when conn and err are set
+
+	conn net.Conn
+	err  error
+}
+
+func (pd *preDial) dial() {
+	defer close(pd.done)
+	defer recoverBackground("pre-dialing", &pd.err)
+	pd.conn, pd.err = pd.dp.getConn(pd.resolver)
+}
+
+// wait blocks until the dial completes and returns its result.
+func (pd *preDial) wait() (net.Conn, error) {
+	<-pd.done
+	return pd.conn, pd.err
+}
+
+// discard closes the pre-dialed connection once the dial completes,
+// for when a different target won the routing decision.
+func (pd *preDial) discard() {
+	go func() {
+		if c, err := pd.wait(); err == nil {
+			c.Close()
+		}
+	}()
+}
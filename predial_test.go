@@ -0,0 +1,129 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// openObserver is an Observer that calls itself when a conn opens.
+type openObserver func()
+
+func (o openObserver) OnConnOpen(net.Conn, uuid.UUID)              { o() }
+func (openObserver) OnBytes(net.Conn, uuid.UUID, int64, int64)     {}
+func (openObserver) OnConnClose(net.Conn, uuid.UUID, int64, int64) {}
+
+func TestProxySNIPreDial(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	lookupStarted := make(chan struct{})
+	dialed := make(chan struct{})
+
+	p := testProxy(t, front)
+	p.PreDial = true
+	p.AddSNIRoute(testFrontAddr, "bar.com", noopTarget{})
+	id := p.AddSNIRoute(testFrontAddr, "foo.com", To(back.Addr().String()))
+	// A slow observer, called once routing has picked the route but
+	// before its target runs. The backend dial must start before it
+	// returns.
+	p.SetRouteObserver(testFrontAddr, id, openObserver(func() {
+		close(lookupStarted)
+		select {
+		case <-dialed:
+		case <-time.After(5 * time.Second):
+			t.Error("backend was not dialed during routing")
+		}
+	}))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	msg := clientHelloRecord(t, "foo.com")
+	io.WriteString(toFront, msg)
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-lookupStarted
+	close(dialed)
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q; want %q", buf, msg)
+	}
+}
+
+func TestConfigPreDialHints(t *testing.T) {
+	var p Proxy
+	dp1, dp2 := To("a:1"), To("b:1")
+	id1 := p.AddSNIRoute(testFrontAddr, "foo.com", dp1)
+	p.AddSNIRoute(testFrontAddr, "foo.com", dp2)
+
+	cfg := p.configFor(testFrontAddr)
+	if got := cfg.preDialHints["foo.com"].dp; got != dp1 {
+		t.Fatalf("hint for foo.com = %v; want first route's target", got)
+	}
+	p.RemoveRouteById(testFrontAddr, id1)
+	if _, ok := cfg.preDialHints["foo.com"]; ok {
+		t.Fatal("hint not removed along with its route")
+	}
+}
+
+func TestConfigPreDialHintsOrdering(t *testing.T) {
+	var p Proxy
+	p.AddSNIRoute(testFrontAddr, "a.com", To("a:1"))
+	p.AddSNIRoute(testFrontAddr, "b.com", To("b:1"))
+	p.AddSNIRoute(testFrontAddr, "x.acme.invalid", To("x:1"))
+	p.AddSNIMatchRoute(testFrontAddr, func(context.Context, string) bool { return true }, To("any:1"))
+	p.AddSNIRoute(testFrontAddr, "c.com", To("c:1"))
+	p.AddRoute(":8443", To("fallback:1"))
+	p.AddSNIRoute(":8443", "d.com", To("d:1"))
+
+	cfg := p.configFor(testFrontAddr)
+	for _, name := range []string{"a.com", "b.com"} {
+		if _, ok := cfg.preDialHints[name]; !ok {
+			t.Errorf("no hint for %s, which only exact routes precede", name)
+		}
+	}
+	// The ACME route catches x.acme.invalid, and the catch-all
+	// routes catch c.com and d.com before their exact routes.
+	for _, name := range []string{"x.acme.invalid", "c.com"} {
+		if hint, ok := cfg.preDialHints[name]; ok {
+			t.Errorf("hint for %s = %s; want none", name, hint.dp.Addr)
+		}
+	}
+	if hint, ok := p.configFor(":8443").preDialHints["d.com"]; ok {
+		t.Errorf("hint for d.com = %s; want none", hint.dp.Addr)
+	}
+}
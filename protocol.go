@@ -0,0 +1,158 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A Protocol is a kind of traffic recognized by DetectProtocol.
+type Protocol int
+
+const (
+	ProtocolUnknown Protocol = iota
+	ProtocolTLS              // TLS handshake record
+	ProtocolHTTP             // HTTP/1.x request, or HTTP/2 prior knowledge preface
+	ProtocolSSH              // SSH identification string
+	ProtocolOpenVPN          // OpenVPN over TCP, initial control packet
+
+	// ProtocolSilent is a client that sent nothing within the
+	// listener's banner wait (see SetBannerWait), as is the case
+	// for server-speaks-first protocols like SMTP.
+	ProtocolSilent
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolUnknown:
+		return "unknown"
+	case ProtocolTLS:
+		return "TLS"
+	case ProtocolHTTP:
+		return "HTTP"
+	case ProtocolSSH:
+		return "SSH"
+	case ProtocolOpenVPN:
+		return "OpenVPN"
+	case ProtocolSilent:
+		return "silent"
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("PATCH "),
+	[]byte("CONNECT "),
+	[]byte("TRACE "),
+	[]byte("PRI * HTTP/2"),
+}
+
+// DetectProtocol classifies a connection by its first bytes, without
+// consuming any bytes from br. It only blocks for as many bytes as
+// it needs to tell the candidate protocols apart.
+//
+// A client that is still silent when a read deadline expires is
+// reported as ProtocolSilent.
+func DetectProtocol(br *bufio.Reader) Protocol {
+	b, err := br.Peek(1)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && br.Buffered() == 0 {
+			return ProtocolSilent
+		}
+		return ProtocolUnknown
+	}
+	switch {
+	case b[0] == 0x16:
+		if b, err := br.Peek(2); err == nil && b[1] == 3 {
+			return ProtocolTLS
+		}
+	case hasPrefix(br, []byte("SSH-")):
+		return ProtocolSSH
+	case b[0] <= openVPNMaxResetLen>>8:
+		// OpenVPN's TCP framing starts with a 16-bit packet length,
+		// whose high byte is small for any handshake packet.
+		if b, err := br.Peek(openVPNHeaderLen); err == nil && isOpenVPNReset(b) {
+			return ProtocolOpenVPN
+		}
+	default:
+		for _, m := range httpMethods {
+			if hasPrefix(br, m) {
+				return ProtocolHTTP
+			}
+		}
+	}
+	return ProtocolUnknown
+}
+
+// hasPrefix reports whether the bytes waiting in br start with
+// prefix. It peeks one byte at a time, so it stops reading as soon
+// as the input diverges from prefix.
+func hasPrefix(br *bufio.Reader, prefix []byte) bool {
+	for i := range prefix {
+		b, err := br.Peek(i + 1)
+		if err != nil || b[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// AddProtocolRoute appends a route to the ipPort listener that routes
+// to dest if DetectProtocol classifies the connection as proto. If it
+// doesn't match, rule processing continues for any additional routes
+// on ipPort.
+//
+// Together with SNI and HTTP Host routes, this lets a single listener
+// serve several protocols, e.g. HTTPS, SSH, OpenVPN and SMTP on
+// :443. Because
+// HTTP Host routes wait for a complete request header, protocol
+// routes should be added before them.
+//
+// The ipPort is any valid net.Listen TCP address.
+func (p *Proxy) AddProtocolRoute(ipPort string, proto Protocol, dest Target) uuid.UUID {
+	return p.addRoute(ipPort, protocolMatch{proto, dest})
+}
+
+// SetBannerWait sets how long connections on the ipPort listener
+// wait for the client to send something before they are classified
+// as ProtocolSilent. It must be set for ProtocolSilent routes to
+// match.
+func (p *Proxy) SetBannerWait(ipPort string, d time.Duration) {
+	p.configFor(ipPort).bannerWait = d
+}
+
+type protocolMatch struct {
+	proto  Protocol
+	target Target
+}
+
+func (m protocolMatch) match(_ context.Context, br *bufio.Reader) (Target, string) {
+	if DetectProtocol(br) == m.proto {
+		return m.target, ""
+	}
+	return nil, ""
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Protocol
+	}{
+		{clientHelloRecord(t, "foo.com"), ProtocolTLS},
+		{"GET / HTTP/1.1\r\n", ProtocolHTTP},
+		{"OPTIONS * HTTP/1.1\r\n", ProtocolHTTP},
+		{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", ProtocolHTTP},
+		{"SSH-2.0-OpenSSH_8.0\r\n", ProtocolSSH},
+		{"GETX", ProtocolUnknown},
+		{"\x16\x01", ProtocolUnknown},
+		{"", ProtocolUnknown},
+	}
+	for _, tt := range tests {
+		got := DetectProtocol(bufio.NewReader(strings.NewReader(tt.in)))
+		if got != tt.want {
+			t.Errorf("DetectProtocol(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDetectProtocolSilent(t *testing.T) {
+	c, peer := net.Pipe()
+	defer c.Close()
+	defer peer.Close()
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if got := DetectProtocol(bufio.NewReader(c)); got != ProtocolSilent {
+		t.Fatalf("DetectProtocol on silent conn = %v; want %v", got, ProtocolSilent)
+	}
+}
+
+func TestProxyProtocolRoutes(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	backSSH := newLocalListener(t)
+	defer backSSH.Close()
+	backSMTP := newLocalListener(t)
+	defer backSMTP.Close()
+
+	p := testProxy(t, front)
+	p.SetBannerWait(testFrontAddr, 50*time.Millisecond)
+	p.AddSNIRoute(testFrontAddr, "foo.com", noopTarget{})
+	p.AddProtocolRoute(testFrontAddr, ProtocolSSH, To(backSSH.Addr().String()))
+	p.AddProtocolRoute(testFrontAddr, ProtocolSilent, To(backSMTP.Addr().String()))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An SSH client speaks first.
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+	const ident = "SSH-2.0-test\r\n"
+	io.WriteString(toFront, ident)
+	fromProxy, err := backSSH.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(ident))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != ident {
+		t.Fatalf("got %q; want %q", buf, ident)
+	}
+
+	// An SMTP client waits for the server's banner.
+	toFront2, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront2.Close()
+	fromProxy2, err := backSMTP.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const banner = "220 mx.example.com ESMTP\r\n"
+	io.WriteString(fromProxy2, banner)
+	buf = make([]byte, len(banner))
+	if _, err := io.ReadFull(toFront2, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != banner {
+		t.Fatalf("got %q; want %q", buf, banner)
+	}
+
+	// The read deadline must be cleared once routed.
+	const ehlo = "EHLO client\r\n"
+	time.Sleep(60 * time.Millisecond)
+	io.WriteString(toFront2, ehlo)
+	buf = make([]byte, len(ehlo))
+	if _, err := io.ReadFull(fromProxy2, buf); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Directions of a recorded chunk.
+const (
+	FromClient byte = 'C' // bytes the client sent to the proxy
+	FromServer byte = 'S' // bytes the proxy sent back to the client
+)
+
+// A RecordedChunk is one read or write observed on a recorded
+// connection.
+type RecordedChunk struct {
+	Dir    byte          // FromClient or FromServer
+	Offset time.Duration // time since the connection was handed to the target
+	Data   []byte
+}
+
+// RecordTarget implements Target by wrapping another Target and
+// recording both directions of each connection to a file in Dir.
+// Recordings can be read back with ReadRecording, or replayed
+// against a backend with the tcpreplay command.
+type RecordTarget struct {
+	// Target receives the recorded connections.
+	Target Target
+
+	// Dir is the directory recordings are written to.
+	Dir string
+
+	// HostName optionally restricts recording to connections whose
+	// SNI or HTTP Host, as seen by the router, equals HostName
+	// once canonicalized (see CanonicalName).
+	// If empty, all connections are recorded.
+	HostName string
+
+	// MaxBytes optionally limits how many bytes of each connection
+	// are recorded. Traffic beyond the limit is still proxied, it
+	// just isn't written to the recording.
+	// If zero, a default is used.
+	MaxBytes int64
+}
+
+var recordSeq uint64
+
+// HandleConn implements the Target interface.
+func (rt *RecordTarget) HandleConn(c net.Conn) {
+	wc, ok := c.(*Conn)
+	if !ok {
+		wc = &Conn{Conn: c}
+	}
+	if rt.HostName != "" && wc.HostName != CanonicalName(rt.HostName) {
+		rt.Target.HandleConn(c)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s-%d.rec",
+		time.Now().UTC().Format("20060102T150405"),
+		recordingName(wc.HostName),
+		atomic.AddUint64(&recordSeq, 1))
+	f, err := os.Create(filepath.Join(rt.Dir, name))
+	if err != nil {
+		log.Printf("tcpproxy: not recording conn %v: %v", c.RemoteAddr().String(), err)
+		rt.Target.HandleConn(c)
+		return
+	}
+
+	rc := &recordConn{
+		Conn:  wc.Conn,
+		f:     f,
+		w:     bufio.NewWriter(f),
+		start: time.Now(),
+		left:  rt.maxBytes(),
+	}
+	if len(wc.Peeked) > 0 {
+		rc.record(FromClient, wc.Peeked)
+	}
+	wc.Conn = rc
+	rt.Target.HandleConn(wc)
+}
+
+func (rt *RecordTarget) maxBytes() int64 {
+	if rt.MaxBytes > 0 {
+		return rt.MaxBytes
+	}
+	return 1 << 20
+}
+
+// recordingName makes hostName safe for use in a file name.
+func recordingName(hostName string) string {
+	if hostName == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, hostName)
+}
+
+// recordConn is a net.Conn that writes everything read from and
+// written to it to a recording file.
+type recordConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	start  time.Time
+	left   int64 // bytes remaining before the recording is truncated
+	closed bool
+}
+
+func (c *recordConn) netConn() net.Conn { return c.Conn }
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.record(FromClient, p[:n])
+	return n, err
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.record(FromServer, p[:n])
+	return n, err
+}
+
+func (c *recordConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.w.Flush()
+		c.f.Close()
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// record appends one chunk to the recording. The chunk header is
+// the direction byte, the offset in nanoseconds as a uint64, and the
+// data length as a uint32, all big-endian.
+func (c *recordConn) record(dir byte, p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.left <= 0 || len(p) == 0 {
+		return
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	c.left -= int64(len(p))
+
+	offset := uint64(time.Since(c.start))
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRecordChunk {
+			chunk = chunk[:maxRecordChunk]
+		}
+		p = p[len(chunk):]
+
+		var hdr [13]byte
+		hdr[0] = dir
+		binary.BigEndian.PutUint64(hdr[1:9], offset)
+		binary.BigEndian.PutUint32(hdr[9:13], uint32(len(chunk)))
+		c.w.Write(hdr[:])
+		c.w.Write(chunk)
+	}
+}
+
+// maxRecordChunk is the most data a recording chunk holds. Larger
+// reads and writes are recorded as several chunks, so that
+// ReadRecording can reject a corrupt chunk length rather than
+// allocating it.
+const maxRecordChunk = 1 << 20
+
+// ReadRecording reads a recording written by RecordTarget.
+func ReadRecording(r io.Reader) ([]RecordedChunk, error) {
+	br := bufio.NewReader(r)
+	var chunks []RecordedChunk
+	for {
+		var hdr [13]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			if err == io.EOF {
+				return chunks, nil
+			}
+			return chunks, fmt.Errorf("reading chunk header: %v", err)
+		}
+		if hdr[0] != FromClient && hdr[0] != FromServer {
+			return chunks, fmt.Errorf("invalid chunk direction %q", hdr[0])
+		}
+		n := binary.BigEndian.Uint32(hdr[9:13])
+		if n > maxRecordChunk {
+			return chunks, fmt.Errorf("chunk of %d bytes exceeds the maximum of %d", n, maxRecordChunk)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return chunks, fmt.Errorf("reading chunk data: %v", err)
+		}
+		chunks = append(chunks, RecordedChunk{
+			Dir:    hdr[0],
+			Offset: time.Duration(binary.BigEndian.Uint64(hdr[1:9])),
+			Data:   data,
+		})
+	}
+}
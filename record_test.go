@@ -0,0 +1,101 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcpproxy-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	got := make(connTarget, 1)
+	rt := &RecordTarget{Target: got, Dir: dir, HostName: "Foo.COM.", MaxBytes: 8}
+
+	client, proxySide := net.Pipe()
+	rt.HandleConn(&Conn{HostName: "foo.com", Peeked: []byte("EHLO"), Conn: proxySide})
+	c := <-got
+
+	go client.Write([]byte(" x\r\n"))
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(c, buf[:4]); err != nil { // peeked
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		t.Fatal(err)
+	}
+	go ioutil.ReadAll(client)
+	c.Write([]byte("250 ok\r\n"))
+	c.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*-foo.com-*.rec"))
+	if len(files) != 1 {
+		t.Fatalf("got recordings %q; want 1", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	chunks, err := ReadRecording(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		dir  byte
+		data string
+	}{
+		{FromClient, "EHLO"},
+		{FromClient, " x\r\n"},
+		// MaxBytes truncates the server's reply.
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf("got %d chunks; want %d", len(chunks), len(want))
+	}
+	for i, w := range want {
+		if chunks[i].Dir != w.dir || string(chunks[i].Data) != w.data {
+			t.Errorf("chunk %d = %c %q; want %c %q", i, chunks[i].Dir, chunks[i].Data, w.dir, w.data)
+		}
+	}
+}
+
+func TestRecordTargetOtherHost(t *testing.T) {
+	got := make(connTarget, 1)
+	rt := &RecordTarget{Target: got, Dir: "/nonexistent", HostName: "foo.com"}
+	a, _ := net.Pipe()
+	in := &Conn{HostName: "bar.com", Conn: a}
+	rt.HandleConn(in)
+	if c := <-got; c != in {
+		t.Fatal("conn for other host was wrapped")
+	}
+}
+
+func TestReadRecordingOversizedChunk(t *testing.T) {
+	hdr := []byte{FromClient, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}
+	if _, err := ReadRecording(bytes.NewReader(hdr)); err == nil {
+		t.Fatal("ReadRecording accepted a 4GB chunk")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Panics returns the number of connections whose handling panicked
+// since the proxy was created. Such panics, whether in a matcher, a
+// Target, or a callback like an Observer, are logged and close only
+// the connection concerned. Panics in the proxy's background work,
+// such as closing connections, dialing warm or pre-dialed backend
+// connections, or the second half of a DialProxy copy after the
+// first has finished, are logged but not counted. Goroutines that
+// Targets start themselves aren't covered.
+func (p *Proxy) Panics() int64 {
+	return atomic.LoadInt64(&p.panics)
+}
+
+// recoverConn recovers a panic while serving c, logs it, counts it
+// and closes c. It must be deferred directly.
+func (p *Proxy) recoverConn(c net.Conn) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	if cp, ok := r.(*copyPanic); ok {
+		r, stack = cp.val, cp.stack
+	}
+	atomic.AddInt64(&p.panics, 1)
+	log.Printf("tcpproxy: panic serving conn %v/%v: %v\n%s", c.RemoteAddr(), c.LocalAddr(), r, stack)
+	c.Close()
+}
+
+// copyPanic is sent on a copier's error channel in place of an error
+// when the copy panics, so that HandleConn can re-raise the panic in
+// the goroutine serving the connection, where serveConn recovers it.
+type copyPanic struct {
+	val   interface{}
+	stack []byte
+}
+
+func (cp *copyPanic) Error() string { return fmt.Sprintf("panic: %v", cp.val) }
+
+// recoverCopy recovers a panic in a copy goroutine and reports it on
+// errc. It must be deferred directly.
+func recoverCopy(errc chan<- error) {
+	if r := recover(); r != nil {
+		errc <- &copyPanic{r, debug.Stack()}
+	}
+}
+
+// repanic re-raises err if it reports a panic in a copy goroutine.
+func repanic(err error) {
+	if cp, ok := err.(*copyPanic); ok {
+		panic(cp)
+	}
+}
+
+// logLateCopy waits for the result of a copy goroutine that is still
+// running after its connection's handler has returned, and logs it
+// if the copy panicked.
+func logLateCopy(errc <-chan error) {
+	if cp, ok := (<-errc).(*copyPanic); ok {
+		log.Printf("tcpproxy: panic copying: %v\n%s", cp.val, cp.stack)
+	}
+}
+
+// recoverBackground recovers a panic in a background goroutine,
+// logs it as happening while doing what, and sets *err to report it.
+// It must be deferred directly.
+func recoverBackground(what string, err *error) {
+	if r := recover(); r != nil {
+		log.Printf("tcpproxy: panic %s: %v\n%s", what, r, debug.Stack())
+		*err = fmt.Errorf("tcpproxy: panic %s: %v", what, r)
+	}
+}
+
+// closeConn closes c, logging rather than crashing the process if
+// the Close of a wrapper, such as an Observer's, panics.
+func closeConn(c net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("tcpproxy: panic closing conn %v/%v: %v\n%s", c.RemoteAddr(), c.LocalAddr(), r, debug.Stack())
+		}
+	}()
+	c.Close()
+}
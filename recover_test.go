@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type panicTarget struct{}
+
+func (panicTarget) HandleConn(net.Conn) { panic("buggy target") }
+
+// panicObserver panics on the first traffic it sees.
+type panicObserver struct{}
+
+func (panicObserver) OnConnOpen(net.Conn, uuid.UUID)                {}
+func (panicObserver) OnBytes(net.Conn, uuid.UUID, int64, int64)     { panic("buggy observer") }
+func (panicObserver) OnConnClose(net.Conn, uuid.UUID, int64, int64) {}
+
+func TestServeConnRecoversPanics(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(p *Proxy)
+	}{
+		{"target", func(p *Proxy) {
+			p.AddRoute(testFrontAddr, panicTarget{})
+		}},
+		{"matcher", func(p *Proxy) {
+			p.AddSNIMatchRoute(testFrontAddr, func(context.Context, string) bool { panic("buggy matcher") }, noopTarget{})
+		}},
+		{"observer", func(p *Proxy) {
+			backend, dst := net.Pipe()
+			go io.Copy(ioutil.Discard, backend)
+			dp := &DialProxy{DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return dst, nil
+			}}
+			id := p.AddRoute(testFrontAddr, dp)
+			p.SetRouteObserver(testFrontAddr, id, panicObserver{})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(Proxy)
+			tt.setup(p)
+
+			client, server := net.Pipe()
+			done := make(chan bool)
+			go func() { done <- p.serveConn(server, p.configFor(testFrontAddr)) }()
+			client.Write([]byte("hello"))
+			if _, err := ioutil.ReadAll(client); err != nil {
+				t.Fatal(err)
+			}
+			<-done
+			if n := p.Panics(); n != 1 {
+				t.Errorf("Panics() = %d; want 1", n)
+			}
+		})
+	}
+}
+
+func TestBackgroundDialsRecoverPanics(t *testing.T) {
+	dp := &DialProxy{
+		Addr:      "backend:1",
+		WarmConns: 1,
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			panic("buggy dialer")
+		},
+	}
+
+	pd := &preDial{dp: dp, done: make(chan struct{})}
+	go pd.dial()
+	if c, err := pd.wait(); c != nil || err == nil {
+		t.Errorf("panicking pre-dial = %v, %v; want an error", c, err)
+	}
+
+	// The panicking warm dial from the pre-dial's get must still
+	// be accounted for, so the pool can try again.
+	pool := dp.connPool()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.mu.Lock()
+		n := pool.dialing
+		pool.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d dials in flight; want 0", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Resolver resolves the host names of DialProxy backends and
+// DNSLookup routes, caching the answers. It can override names with
+// static addresses and query specific DNS servers. Set it as
+// Proxy.Resolver to use it for all of a proxy's routes, or as
+// DialProxy.Resolver or DNSLookup.Resolver for a single route.
+//
+// The zero value queries net.DefaultResolver and caches answers for
+// 30 seconds.
+type Resolver struct {
+	// Static optionally maps host names to the addresses to use for
+	// them, like a hosts file. Static names are never looked up in
+	// DNS.
+	Static map[string][]string
+
+	// Servers optionally lists the DNS servers to query, as "ip" or
+	// "ip:port" (port 53 is the default), instead of the system's.
+	// Queries rotate through them, so a query that times out is
+	// retried on the next server.
+	Servers []string
+
+	// Resolver optionally specifies the resolver to use when
+	// Servers is empty. Its Dial function can be set to reach an
+	// upstream over DNS over TLS or HTTPS.
+	// If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+
+	// CacheTTL is how long answers are reused. The net package
+	// doesn't report record TTLs, so this applies to all names.
+	// If zero, a default is used. To disable, use a negative number.
+	CacheTTL time.Duration
+
+	// lookupHost, if non-nil, replaces DNS in tests.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	servers *net.Resolver // built from Servers
+	cache   map[string]resolverEntry
+}
+
+// defaultResolver is used by DNSLookups without a Resolver.
+var defaultResolver = new(Resolver)
+
+type resolverEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// LookupHost returns the addresses of host, from Static, the cache,
+// or DNS.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	name := CanonicalName(host)
+	for k, addrs := range r.Static {
+		if CanonicalName(k) == name {
+			return addrs, nil
+		}
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	e, ok := r.cache[name]
+	r.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	addrs, err := r.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("tcpproxy: no addresses for %q", name)
+	}
+
+	if ttl := r.cacheTTL(); ttl > 0 {
+		r.mu.Lock()
+		if r.cache == nil {
+			r.cache = make(map[string]resolverEntry)
+		}
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		r.cache[name] = resolverEntry{addrs, now.Add(ttl)}
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+func (r *Resolver) lookup(ctx context.Context, host string) ([]string, error) {
+	if r.lookupHost != nil {
+		return r.lookupHost(ctx, host)
+	}
+	return r.netResolver().LookupHost(ctx, host)
+}
+
+// netResolver returns the net.Resolver to query.
+func (r *Resolver) netResolver() *net.Resolver {
+	if len(r.Servers) == 0 {
+		if r.Resolver != nil {
+			return r.Resolver
+		}
+		return net.DefaultResolver
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.servers == nil {
+		servers := make([]string, len(r.Servers))
+		for i, s := range r.Servers {
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				s = net.JoinHostPort(s, "53")
+			}
+			servers[i] = s
+		}
+		var next uint32
+		r.servers = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				i := atomic.AddUint32(&next, 1) - 1
+				var d net.Dialer
+				return d.DialContext(ctx, network, servers[int(i)%len(servers)])
+			},
+		}
+	}
+	return r.servers
+}
+
+func (r *Resolver) cacheTTL() time.Duration {
+	if r.CacheTTL != 0 {
+		return r.CacheTTL
+	}
+	return 30 * time.Second
+}
+
+// dial connects to address with dial, resolving its host with r.
+// The resolved addresses are tried in order until one connects.
+func (r *Resolver) dial(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return dial(ctx, "tcp", address)
+	}
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var c net.Conn
+		if c, err = dial(ctx, "tcp", net.JoinHostPort(a, port)); err == nil || ctx.Err() != nil {
+			return c, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestResolverLookupHost(t *testing.T) {
+	var lookups []string
+	r := &Resolver{
+		Static: map[string][]string{"Static.Test": {"192.0.2.1"}},
+		lookupHost: func(_ context.Context, host string) ([]string, error) {
+			lookups = append(lookups, host)
+			if host == "missing.test" {
+				return nil, errors.New("no such host")
+			}
+			return []string{"198.51.100.1"}, nil
+		},
+	}
+	ctx := context.Background()
+	for _, host := range []string{"static.test.", "dns.test", "DNS.test", "missing.test", "missing.test"} {
+		r.LookupHost(ctx, host)
+	}
+	if got, err := r.LookupHost(ctx, "static.test"); err != nil || !reflect.DeepEqual(got, []string{"192.0.2.1"}) {
+		t.Errorf("static.test = %q, %v; want the static address", got, err)
+	}
+	// dns.test is cached after its first lookup; failures aren't.
+	if want := []string{"dns.test", "missing.test", "missing.test"}; !reflect.DeepEqual(lookups, want) {
+		t.Errorf("looked up %q; want %q", lookups, want)
+	}
+
+	r.CacheTTL = -1
+	lookups = nil
+	r.cache = nil
+	r.LookupHost(ctx, "dns.test")
+	r.LookupHost(ctx, "dns.test")
+	if len(lookups) != 2 {
+		t.Errorf("with caching disabled, looked up %q; want 2 lookups", lookups)
+	}
+}
+
+func TestResolverDialsEachAddress(t *testing.T) {
+	var dialed []string
+	r := &Resolver{Static: map[string][]string{"backend.test": {"192.0.2.1", "192.0.2.2"}}}
+	dial := func(_ context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "192.0.2.1:443" {
+			return nil, errors.New("connection refused")
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	c, err := r.dial(context.Background(), dial, "backend.test:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if want := []string{"192.0.2.1:443", "192.0.2.2:443"}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dialed %q; want %q", dialed, want)
+	}
+}
+
+func TestProxyResolver(t *testing.T) {
+	back := newLocalListener(t)
+	defer back.Close()
+	_, port, _ := net.SplitHostPort(back.Addr().String())
+
+	p := &Proxy{Resolver: &Resolver{Static: map[string][]string{"backend.test": {"127.0.0.1"}}}}
+	p.AddRoute(testFrontAddr, To(net.JoinHostPort("backend.test", port)))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go p.serveConn(server, p.configFor(testFrontAddr))
+	c, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
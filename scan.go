@@ -0,0 +1,222 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A ScanGuard detects clients that look like port scanners or TLS
+// probes, which open many connections that match no route, and
+// temporarily bans them. It also throttles the proxy's per-connection
+// "no routes matched" logging, so scans don't flood the log.
+//
+// Set Proxy.ScanGuard to use one. Its zero value is ready to use with
+// default thresholds.
+type ScanGuard struct {
+	// Threshold is how many unmatched connections a client may
+	// make within Window before it is banned.
+	// If zero, a default of 10 is used.
+	Threshold int
+
+	// Window is the period over which unmatched connections are
+	// counted.
+	// If zero, a default of one minute is used.
+	Window time.Duration
+
+	// BanDuration is how long banned clients' connections are
+	// closed without being read from.
+	// If zero, a default of ten minutes is used.
+	BanDuration time.Duration
+
+	// BanLog optionally receives a line for each ban, in a format
+	// suited to fail2ban or similar tools:
+	//
+	//	2006-01-02T15:04:05Z tcpproxy: banned 192.0.2.1 for 10m0s after 10 unmatched connections
+	//
+	// A fail2ban failregex for it is
+	// "tcpproxy: banned <HOST> for".
+	BanLog io.Writer
+
+	// LogInterval is the minimum time between "no routes matched"
+	// log lines for any one client; the rest are counted and
+	// reported with the next line.
+	// If zero, a default of one minute is used.
+	LogInterval time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*scanClient // by IP
+	lastSweep time.Time
+}
+
+type scanClient struct {
+	misses      []time.Time // unmatched connections within Window
+	bannedUntil time.Time
+	lastLog     time.Time
+	suppressed  int // log lines skipped since lastLog
+}
+
+// clientIP returns the IP of c's remote address, used to key scan
+// tracking, or the empty string for non-IP connections.
+func clientIP(c net.Conn) string {
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return unmapIP(a.IP).String()
+	}
+	return ""
+}
+
+// banned reports whether ip is currently banned.
+func (g *ScanGuard) banned(ip string) bool {
+	if ip == "" {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sc := g.clients[ip]
+	return sc != nil && time.Now().Before(sc.bannedUntil)
+}
+
+// miss records that c matched no route, for reason, bans its client
+// if it exceeded the threshold, and logs the miss subject to
+// LogInterval.
+func (g *ScanGuard) miss(c net.Conn, reason MissReason) {
+	ip := clientIP(c)
+	if ip == "" {
+		log.Printf("tcpproxy: no routes matched conn %v/%v (%s); closing", c.RemoteAddr(), c.LocalAddr(), reason)
+		return
+	}
+	now := time.Now()
+
+	g.mu.Lock()
+	g.sweepLocked(now)
+	if g.clients == nil {
+		g.clients = make(map[string]*scanClient)
+	}
+	sc := g.clients[ip]
+	if sc == nil {
+		sc = new(scanClient)
+		g.clients[ip] = sc
+	}
+	sc.misses = append(recentMisses(sc.misses, now.Add(-g.window())), now)
+	var ban bool
+	misses := len(sc.misses)
+	if misses >= g.threshold() && now.After(sc.bannedUntil) {
+		ban = true
+		sc.bannedUntil = now.Add(g.banDuration())
+		if g.BanLog != nil {
+			// Written under g.mu, so lines from concurrent
+			// bans don't interleave.
+			fmt.Fprintf(g.BanLog, "%s tcpproxy: banned %s for %v after %d unmatched connections\n",
+				now.UTC().Format(time.RFC3339), ip, g.banDuration(), misses)
+		}
+	}
+	logIt := now.Sub(sc.lastLog) >= g.logInterval()
+	suppressed := sc.suppressed
+	if logIt {
+		sc.lastLog, sc.suppressed = now, 0
+	} else {
+		sc.suppressed++
+	}
+	g.mu.Unlock()
+
+	if logIt {
+		var more string
+		if suppressed > 0 {
+			more = fmt.Sprintf(" (%d more since last logged)", suppressed)
+		}
+		log.Printf("tcpproxy: no routes matched conn %v/%v (%s); closing%s", c.RemoteAddr(), c.LocalAddr(), reason, more)
+	}
+	if ban {
+		log.Printf("tcpproxy: banning %s for %v after %d unmatched connections", ip, g.banDuration(), misses)
+	}
+}
+
+// recentMisses returns the misses after since, reusing ms.
+func recentMisses(ms []time.Time, since time.Time) []time.Time {
+	i := sort.Search(len(ms), func(i int) bool { return ms[i].After(since) })
+	return append(ms[:0], ms[i:]...)
+}
+
+// sweepLocked forgets clients with no recent misses and no ban, at
+// most once per Window.
+func (g *ScanGuard) sweepLocked(now time.Time) {
+	if now.Sub(g.lastSweep) < g.window() {
+		return
+	}
+	g.lastSweep = now
+	since := now.Add(-g.window())
+	for ip, sc := range g.clients {
+		sc.misses = recentMisses(sc.misses, since)
+		if now.After(sc.bannedUntil) && len(sc.misses) == 0 {
+			delete(g.clients, ip)
+		}
+	}
+}
+
+// Banned returns the currently banned client IPs, sorted.
+func (g *ScanGuard) Banned() []string {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var ips []string
+	for ip, sc := range g.clients {
+		if now.Before(sc.bannedUntil) {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// Unban lifts any ban on ip and forgets its unmatched connections.
+func (g *ScanGuard) Unban(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.clients, ip)
+}
+
+func (g *ScanGuard) threshold() int {
+	if g.Threshold > 0 {
+		return g.Threshold
+	}
+	return 10
+}
+
+func (g *ScanGuard) window() time.Duration {
+	if g.Window > 0 {
+		return g.Window
+	}
+	return time.Minute
+}
+
+func (g *ScanGuard) banDuration() time.Duration {
+	if g.BanDuration > 0 {
+		return g.BanDuration
+	}
+	return 10 * time.Minute
+}
+
+func (g *ScanGuard) logInterval() time.Duration {
+	if g.LogInterval > 0 {
+		return g.LogInterval
+	}
+	return time.Minute
+}
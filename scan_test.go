@@ -0,0 +1,100 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// remoteAddrConn is a net.Conn with a fixed remote address.
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestScanGuard(t *testing.T) {
+	var banLog bytes.Buffer
+	g := &ScanGuard{Threshold: 3, BanDuration: time.Hour, BanLog: &banLog}
+	p := &Proxy{ScanGuard: g}
+	p.AddSNIRoute(testFrontAddr, "foo.com", noopTarget{})
+	cfg := p.configFor(testFrontAddr)
+
+	conn := func(ip string) net.Conn {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+			client.Close()
+		}()
+		return remoteAddrConn{server, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}
+	}
+
+	for i := 0; i < 3; i++ {
+		if p.serveConn(conn("192.0.2.1"), cfg) {
+			t.Fatal("unexpected match")
+		}
+	}
+	if got := g.Banned(); len(got) != 1 || got[0] != "192.0.2.1" {
+		t.Fatalf("Banned() = %q; want [192.0.2.1]", got)
+	}
+	if !strings.Contains(banLog.String(), "tcpproxy: banned 192.0.2.1 for 1h0m0s after 3 unmatched connections") {
+		t.Errorf("ban log = %q", banLog.String())
+	}
+	if !g.banned("192.0.2.1") || g.banned("192.0.2.2") {
+		t.Error("ban applied to the wrong clients")
+	}
+
+	g.Unban("192.0.2.1")
+	if g.banned("192.0.2.1") {
+		t.Error("still banned after Unban")
+	}
+}
+
+func TestScanGuardLogThrottle(t *testing.T) {
+	g := &ScanGuard{Threshold: 100, LogInterval: time.Hour}
+	a, _ := net.Pipe()
+	c := remoteAddrConn{a, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+	for i := 0; i < 5; i++ {
+		g.miss(c, MissNoRouteMatched)
+	}
+	if sc := g.clients["192.0.2.1"]; sc.suppressed != 4 || len(sc.misses) != 5 {
+		t.Errorf("suppressed %d, counted %d misses; want 4, 5", sc.suppressed, len(sc.misses))
+	}
+}
+
+func TestScanGuardSweepKeepsCounts(t *testing.T) {
+	g := &ScanGuard{Threshold: 4, Window: time.Minute}
+	now := time.Now()
+	g.clients = map[string]*scanClient{"192.0.2.1": {misses: []time.Time{
+		now.Add(-3 * time.Minute), now.Add(-20 * time.Second), now.Add(-10 * time.Second),
+	}}}
+	a, _ := net.Pipe()
+	c := remoteAddrConn{a, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+
+	// The miss sweeps first; the expired miss must not be replaced
+	// by a copy of a recent one.
+	g.miss(c, MissNoRouteMatched)
+	if n := len(g.clients["192.0.2.1"].misses); n != 3 {
+		t.Errorf("counted %d misses; want 3", n)
+	}
+	if g.banned("192.0.2.1") {
+		t.Error("banned below Threshold")
+	}
+}
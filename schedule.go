@@ -0,0 +1,206 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule is a set of recurring weekly time windows, such as a
+// nightly maintenance window. See ParseSchedule.
+type Schedule struct {
+	spec    string
+	loc     *time.Location
+	windows []scheduleWindow
+	now     func() time.Time // for tests
+}
+
+type scheduleWindow struct {
+	days       [7]bool // by time.Weekday
+	start, end int     // minutes since midnight; end <= start crosses midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseSchedule parses a schedule of semicolon-separated windows,
+// interpreted in loc (or UTC if loc is nil). Each window is an
+// optional list of days followed by a time range:
+//
+//	02:00-04:00                  every day from 2am to 4am
+//	Mon-Fri 22:00-06:00          weeknights, ending the next morning
+//	Sat,Sun 00:00-24:00; 12:00-13:00
+//
+// Days are three-letter English names, alone or as ranges, which may
+// wrap around the week (Fri-Mon). A window whose end is not after its
+// start crosses midnight, and belongs to the day it starts on.
+func ParseSchedule(spec string, loc *time.Location) (*Schedule, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	s := &Schedule{spec: spec, loc: loc}
+	for _, w := range strings.Split(spec, ";") {
+		fields := strings.Fields(w)
+		var win scheduleWindow
+		var times string
+		switch len(fields) {
+		case 1:
+			for d := range win.days {
+				win.days[d] = true
+			}
+			times = fields[0]
+		case 2:
+			if err := parseDays(fields[0], &win.days); err != nil {
+				return nil, err
+			}
+			times = fields[1]
+		default:
+			return nil, fmt.Errorf("tcpproxy: bad schedule window %q", strings.TrimSpace(w))
+		}
+		i := strings.Index(times, "-")
+		if i < 0 {
+			return nil, fmt.Errorf("tcpproxy: bad schedule time range %q", times)
+		}
+		var err error
+		if win.start, err = parseClock(times[:i]); err != nil {
+			return nil, err
+		}
+		if win.end, err = parseClock(times[i+1:]); err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, win)
+	}
+	return s, nil
+}
+
+func parseDays(spec string, days *[7]bool) error {
+	for _, item := range strings.Split(strings.ToLower(spec), ",") {
+		from, to := item, item
+		if i := strings.Index(item, "-"); i >= 0 {
+			from, to = item[:i], item[i+1:]
+		}
+		first, ok1 := weekdays[from]
+		last, ok2 := weekdays[to]
+		if !ok1 || !ok2 {
+			return fmt.Errorf("tcpproxy: bad schedule days %q", item)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses "HH:MM", including "24:00", into minutes since
+// midnight.
+func parseClock(s string) (int, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return 0, fmt.Errorf("tcpproxy: bad schedule time %q", s)
+	}
+	h, err1 := strconv.Atoi(s[:i])
+	m, err2 := strconv.Atoi(s[i+1:])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("tcpproxy: bad schedule time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// Active reports whether t falls within one of s's windows.
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.loc)
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	min := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[day] && min >= w.start && min < w.end {
+				return true
+			}
+			continue
+		}
+		if (w.days[day] && min >= w.start) || (w.days[yesterday] && min < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the spec s was parsed from, followed by its time
+// zone.
+func (s *Schedule) String() string {
+	return s.spec + " " + s.loc.String()
+}
+
+// activeNow reports whether s is active now. A nil Schedule is never
+// active.
+func (s *Schedule) activeNow() bool {
+	if s == nil {
+		return false
+	}
+	if s.now != nil {
+		return s.Active(s.now())
+	}
+	return s.Active(time.Now())
+}
+
+// Matcher returns a Matcher that accepts hostnames accepted by m, but
+// only while s is active. Together with AddSNIMatchRoute or
+// AddHTTPHostMatchRoute, it makes a route that only applies during
+// the schedule's windows.
+func (s *Schedule) Matcher(m Matcher) Matcher {
+	return func(ctx context.Context, hostname string) bool {
+		return s.activeNow() && m(ctx, hostname)
+	}
+}
+
+// ScheduledTarget implements Target by sending connections to During
+// while Schedule is active and to Otherwise the rest of the time,
+// for example to shift traffic to a standby backend during nightly
+// maintenance. The choice is made when each connection arrives;
+// connections in progress are not moved.
+//
+// A nil Schedule is never active. Connections for a nil During or
+// Otherwise are closed, so leaving one unset refuses connections
+// outside or during the schedule's windows.
+type ScheduledTarget struct {
+	Schedule  *Schedule
+	During    Target
+	Otherwise Target
+}
+
+// HandleConn implements the Target interface.
+func (st *ScheduledTarget) HandleConn(c net.Conn) {
+	t := st.Otherwise
+	if st.Schedule.activeNow() {
+		t = st.During
+	}
+	if t == nil {
+		c.Close()
+		return
+	}
+	t.HandleConn(c)
+}
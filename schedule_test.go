@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	// 2017-01-02 was a Monday.
+	at := func(day int, clock string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", fmt.Sprintf("2017-01-%02d %s", day, clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		spec   string
+		t      time.Time
+		active bool
+	}{
+		{"02:00-04:00", at(2, "02:00"), true},
+		{"02:00-04:00", at(2, "04:00"), false},
+		{"02:00-04:00", at(8, "03:59"), true},
+		{"Mon-Fri 22:00-06:00", at(2, "23:00"), true},  // Monday night
+		{"Mon-Fri 22:00-06:00", at(3, "05:59"), true},  // Tuesday morning
+		{"Mon-Fri 22:00-06:00", at(2, "05:59"), false}, // Monday morning follows Sunday
+		{"Mon-Fri 22:00-06:00", at(7, "23:00"), false}, // Saturday night
+		{"Fri-Mon 00:00-24:00", at(8, "12:00"), true},  // Sunday
+		{"Fri-Mon 00:00-24:00", at(4, "12:00"), false}, // Wednesday
+		{"Sat,Sun 10:00-11:00; 12:00-13:00", at(4, "12:30"), true},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec, nil)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.Active(tt.t); got != tt.active {
+			t.Errorf("%q Active(%v) = %v; want %v", tt.spec, tt.t.Format("Mon 15:04"), got, tt.active)
+		}
+	}
+
+	for _, bad := range []string{"", "2:00", "Mon 02:00-25:00", "Funday 01:00-02:00", "Mon Tue 01:00-02:00"} {
+		if _, err := ParseSchedule(bad, nil); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestScheduledTarget(t *testing.T) {
+	s, err := ParseSchedule("02:00-04:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, standby := make(connTarget, 1), make(connTarget, 1)
+	st := &ScheduledTarget{Schedule: s, During: standby, Otherwise: primary}
+
+	s.now = func() time.Time { return time.Date(2017, 1, 2, 3, 0, 0, 0, time.UTC) }
+	c, _ := net.Pipe()
+	st.HandleConn(c)
+	if len(standby) != 1 {
+		t.Error("conn during the window did not go to the standby")
+	}
+	if !s.Matcher(equals("foo.com"))(context.Background(), "foo.com") {
+		t.Error("Matcher did not match during the window")
+	}
+
+	s.now = func() time.Time { return time.Date(2017, 1, 2, 5, 0, 0, 0, time.UTC) }
+	st.HandleConn(c)
+	if len(primary) != 1 {
+		t.Error("conn outside the window did not go to the primary")
+	}
+	if s.Matcher(equals("foo.com"))(context.Background(), "foo.com") {
+		t.Error("Matcher matched outside the window")
+	}
+}
+
+func TestScheduledTargetNil(t *testing.T) {
+	during := make(connTarget, 1)
+	st := &ScheduledTarget{During: during}
+
+	// A nil Schedule is never active, and there's no Otherwise, so
+	// the conn is closed.
+	client, c := net.Pipe()
+	st.HandleConn(c)
+	if len(during) != 0 {
+		t.Error("conn went to During without a Schedule")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("reading conn with no target: %v; want EOF", err)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SetRouteShedHandler sets how connections matched by the route
+// routeId on the ipPort listener are refused when the proxy sheds
+// them: when their Namespace is at its MaxConns quota, their
+// TargetGroup has no available members, or their DialProxy can't
+// reach its backend and has no OnDialError. By default, shed
+// connections are closed.
+//
+// For SMTP routes, use DeferSMTP so that sending servers retry
+// later instead of bouncing mail.
+func (p *Proxy) SetRouteShedHandler(ipPort string, routeId uuid.UUID, h func(c net.Conn)) {
+	cfg := p.configFor(ipPort)
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if cfg.shedHandlers == nil {
+		cfg.shedHandlers = make(map[uuid.UUID]func(net.Conn))
+	}
+	cfg.shedHandlers[routeId] = h
+}
+
+func (c *config) shedHandler(routeId uuid.UUID) func(net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shedHandlers[routeId]
+}
+
+// shed refuses c, using the shed handler of the route that matched
+// it, if any.
+func shed(c net.Conn) {
+	if wc, ok := c.(*Conn); ok && wc.shed != nil {
+		wc.shed(wc)
+		return
+	}
+	c.Close()
+}
+
+// smtpDeferTimeout bounds how long DeferSMTP waits to write its
+// reply to a client that isn't reading.
+const smtpDeferTimeout = 5 * time.Second
+
+// DeferSMTP tells the SMTP client on c that the service is
+// temporarily unavailable, with a "421 4.3.2" reply, and closes c.
+// Sending servers queue the message and retry later. It is meant to
+// be used with SetRouteShedHandler, for routes whose clients wait for
+// the server's greeting.
+func DeferSMTP(c net.Conn) {
+	c.SetWriteDeadline(time.Now().Add(smtpDeferTimeout))
+	io.WriteString(c, "421 4.3.2 Service shutting down, try again later\r\n")
+	c.Close()
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestShedDefersSMTP(t *testing.T) {
+	// A backend address that refuses connections.
+	ln := newLocalListener(t)
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name string
+		dest Target
+	}{
+		{"dial error", To(deadAddr)},
+		{"empty group", new(TargetGroup)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(Proxy)
+			id := p.AddRoute(testFrontAddr, tt.dest)
+			p.SetRouteShedHandler(testFrontAddr, id, DeferSMTP)
+
+			client, server := net.Pipe()
+			go p.serveConn(server, p.configFor(testFrontAddr))
+			got, err := ioutil.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "421 4.3.2 Service shutting down, try again later\r\n"; string(got) != want {
+				t.Errorf("client got %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestShedClosesByDefault(t *testing.T) {
+	p := new(Proxy)
+	p.AddRoute(testFrontAddr, new(TargetGroup))
+
+	client, server := net.Pipe()
+	go p.serveConn(server, p.configFor(testFrontAddr))
+	got, err := ioutil.ReadAll(client)
+	if err != nil || len(got) != 0 {
+		t.Errorf("client got %q, %v; want a closed connection", got, err)
+	}
+}
@@ -38,7 +38,17 @@ import (
 //
 // The ipPort is any valid net.Listen TCP address.
 func (p *Proxy) AddSNIRoute(ipPort, sni string, dest Target) uuid.UUID {
-	return p.AddSNIMatchRoute(ipPort, equals(sni), dest)
+	return p.addSNIRoute(ipPort, sni, dest, uuid.New())
+}
+
+// addSNIRoute is AddSNIRoute with the route id chosen by the caller.
+func (p *Proxy) addSNIRoute(ipPort, sni string, dest Target, routeId uuid.UUID) uuid.UUID {
+	p.addSNIMatchRoute(ipPort, equals(sni), dest, routeId)
+	p.configFor(ipPort).setRouteName(routeId, sni)
+	if dp, ok := dest.(*DialProxy); ok {
+		p.configFor(ipPort).addPreDialHint(sni, routeId, dp)
+	}
+	return routeId
 }
 
 // No ACME, ACME challenge/response expected to be done at other end
@@ -57,8 +67,10 @@ func (p *Proxy) AddSNIDynamicRoute(ipPort string, targetLookup TargetLookup) uui
 //
 // The ipPort is any valid net.Listen TCP address.
 func (p *Proxy) AddSNIMatchRoute(ipPort string, matcher Matcher, dest Target) uuid.UUID {
-	routeId := uuid.New()
+	return p.addSNIMatchRoute(ipPort, matcher, dest, uuid.New())
+}
 
+func (p *Proxy) addSNIMatchRoute(ipPort string, matcher Matcher, dest Target, routeId uuid.UUID) uuid.UUID {
 	cfg := p.configFor(ipPort)
 	if !cfg.stopACME {
 		if len(cfg.acmeTargets) == 0 {
@@ -84,15 +96,15 @@ type dynamicSNIMatch struct {
 	dynMatcher TargetLookup
 }
 
-func (m dynamicSNIMatch) match(br *bufio.Reader) (Target, string) {
-	sni := clientHelloServerName(br)
+func (m dynamicSNIMatch) match(ctx context.Context, br *bufio.Reader) (Target, string) {
+	sni := canonicalName(ctx, clientHelloServerName(br))
 
 	if m.dynMatcher == nil {
 		return nil, ""
 
 	}
 
-	targetAddr, err := m.dynMatcher(context.TODO(), sni)
+	targetAddr, err := m.dynMatcher(ctx, sni)
 	if err != nil {
 		return nil, ""
 	}
@@ -105,9 +117,9 @@ type sniMatch struct {
 	target  Target
 }
 
-func (m sniMatch) match(br *bufio.Reader) (Target, string) {
-	sni := clientHelloServerName(br)
-	if m.matcher(context.TODO(), sni) {
+func (m sniMatch) match(ctx context.Context, br *bufio.Reader) (Target, string) {
+	sni := canonicalName(ctx, clientHelloServerName(br))
+	if m.matcher(ctx, sni) {
 		return m.target, sni
 	}
 	return nil, ""
@@ -120,8 +132,8 @@ type acmeMatch struct {
 	cfg *config
 }
 
-func (m *acmeMatch) match(br *bufio.Reader) (Target, string) {
-	sni := clientHelloServerName(br)
+func (m *acmeMatch) match(ctx context.Context, br *bufio.Reader) (Target, string) {
+	sni := canonicalName(ctx, clientHelloServerName(br))
 	if !strings.HasSuffix(sni, ".acme.invalid") {
 		return nil, ""
 	}
@@ -130,8 +142,7 @@ func (m *acmeMatch) match(br *bufio.Reader) (Target, string) {
 	// burst for each issuance event. A short TTL cache + singleflight
 	// should have an excellent hit rate.
 	// TODO: maybe an acme-specific timeout as well?
-	// TODO: plumb context upwards?
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	ch := make(chan Target, len(m.cfg.acmeTargets))
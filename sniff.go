@@ -0,0 +1,138 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+)
+
+// A MissReason says why a connection matched no route.
+type MissReason string
+
+const (
+	// MissNoRouteMatched means the client sent a TLS SNI name or
+	// HTTP Host that no route accepted.
+	MissNoRouteMatched MissReason = "no route matched"
+
+	// MissNotTLS means the client sent neither a TLS ClientHello
+	// nor an HTTP request with a Host header, or closed the
+	// connection without sending anything.
+	MissNotTLS MissReason = "not TLS"
+
+	// MissNoSNI means the client sent a TLS ClientHello without
+	// a server name.
+	MissNoSNI MissReason = "no SNI"
+
+	// MissSniffTimeout means the client didn't send enough to
+	// route on before SniffTimeout or the listener's banner wait
+	// expired.
+	MissSniffTimeout MissReason = "sniff timeout"
+
+	// MissSniffTooLarge means the routing header didn't fit in
+	// MaxSniffSize bytes.
+	MissSniffTooLarge MissReason = "sniff buffer full"
+
+	// MissBanned means the client was banned by ScanGuard.
+	MissBanned MissReason = "client banned by ScanGuard"
+)
+
+// sniffReader reads from a connection being routed, remembering the
+// last read error so that a miss can be classified afterwards.
+type sniffReader struct {
+	c   net.Conn
+	err error
+}
+
+func (r *sniffReader) Read(p []byte) (int, error) {
+	n, err := r.c.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// newSniffReader returns the buffered reader that routes peek at.
+func (p *Proxy) newSniffReader(c net.Conn) (*bufio.Reader, *sniffReader) {
+	sr := &sniffReader{c: c}
+	if p.MaxSniffSize > 0 {
+		return bufio.NewReaderSize(sr, p.MaxSniffSize), sr
+	}
+	return bufio.NewReader(sr), sr
+}
+
+// classifyMiss says why the connection buffered in br matched no
+// route. readErr is the last error reading from the connection, if
+// any. It only examines bytes already buffered, so it doesn't block.
+func classifyMiss(br *bufio.Reader, readErr error) MissReason {
+	if ne, ok := readErr.(net.Error); ok && ne.Timeout() {
+		return MissSniffTimeout
+	}
+	n := br.Buffered()
+	if n > 0 && n == br.Size() {
+		return MissSniffTooLarge
+	}
+	peeked, _ := br.Peek(n)
+	const recordTypeHandshake = 0x16
+	if len(peeked) > 0 && peeked[0] == recordTypeHandshake {
+		if clientHelloServerName(bufio.NewReader(bytes.NewReader(peeked))) == "" {
+			return MissNoSNI
+		}
+		return MissNoRouteMatched
+	}
+	if httpHostHeader(bufio.NewReader(bytes.NewReader(peeked))) != "" {
+		return MissNoRouteMatched
+	}
+	return MissNotTLS
+}
+
+// noteMiss counts a connection that matched no route and reports it
+// to OnMiss, if set.
+func (p *Proxy) noteMiss(c net.Conn, reason MissReason) {
+	p.mu.Lock()
+	if p.missCounts == nil {
+		p.missCounts = make(map[MissReason]int64)
+	}
+	p.missCounts[reason]++
+	p.mu.Unlock()
+
+	if p.OnMiss != nil {
+		p.OnMiss(c, reason)
+	}
+}
+
+// MissCounts returns the number of connections that matched no route
+// since the proxy was created, by reason.
+func (p *Proxy) MissCounts() map[MissReason]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counts := make(map[MissReason]int64, len(p.missCounts))
+	for reason, n := range p.missCounts {
+		counts[reason] = n
+	}
+	return counts
+}
+
+// logMiss logs a connection that matched no route, unless ScanGuard
+// is throttling such logs.
+func (p *Proxy) logMiss(c net.Conn, reason MissReason) {
+	if p.ScanGuard != nil {
+		p.ScanGuard.miss(c, reason)
+		return
+	}
+	log.Printf("tcpproxy: no routes matched conn %v/%v (%s); closing", c.RemoteAddr().String(), c.LocalAddr().String(), reason)
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMissReasons(t *testing.T) {
+	noSNI := new(recordWritesConn)
+	tls.Client(noSNI, &tls.Config{InsecureSkipVerify: true}).Handshake()
+
+	tests := []struct {
+		name   string
+		p      *Proxy
+		send   string
+		hangUp bool // close the client after sending
+		want   MissReason
+	}{
+		{"unknown SNI", &Proxy{}, clientHelloRecord(t, "bar.com"), true, MissNoRouteMatched},
+		{"unknown Host", &Proxy{}, "GET / HTTP/1.1\r\nHost: bar.com\r\n\r\n", true, MissNoRouteMatched},
+		{"no SNI", &Proxy{}, noSNI.buf.String(), true, MissNoSNI},
+		{"garbage", &Proxy{}, "SSH-2.0-OpenSSH_8.9\r\n", true, MissNotTLS},
+		{"silent", &Proxy{}, "", true, MissNotTLS},
+		{"slow", &Proxy{SniffTimeout: 50 * time.Millisecond}, "\x16\x03\x01", false, MissSniffTimeout},
+		{"oversized", &Proxy{MaxSniffSize: 64}, clientHelloRecord(t, "foo.com"), false, MissSniffTooLarge},
+		{"oversized HTTP", &Proxy{MaxSniffSize: 64}, "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("x", 100), false, MissSniffTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.p
+			var got []MissReason
+			p.OnMiss = func(c net.Conn, reason MissReason) { got = append(got, reason) }
+			p.AddSNIRoute(testFrontAddr, "foo.com", noopTarget{})
+			p.AddHTTPHostRoute(testFrontAddr, "foo.com", noopTarget{})
+
+			client, server := net.Pipe()
+			defer client.Close()
+			send, hangUp := tt.send, tt.hangUp
+			go func() {
+				client.Write([]byte(send))
+				if hangUp {
+					client.Close()
+				}
+			}()
+			if p.serveConn(server, p.configFor(testFrontAddr)) {
+				t.Fatal("serveConn routed the connection")
+			}
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("OnMiss got %q; want [%q]", got, tt.want)
+			}
+			if n := p.MissCounts()[tt.want]; n != 1 {
+				t.Errorf("MissCounts()[%q] = %d; want 1", tt.want, n)
+			}
+		})
+	}
+}
+
+func TestMaxSniffSizeAllowsLargeHeaders(t *testing.T) {
+	p := &Proxy{MaxSniffSize: 16 << 10}
+	got := make(connTarget, 1)
+	p.AddHTTPHostRoute(testFrontAddr, "foo.com", got)
+
+	// The default 4 KB buffer can't hold this request header.
+	req := "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("x", 8<<10) + "\r\nHost: foo.com\r\n\r\n"
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte(req))
+	if !p.serveConn(server, p.configFor(testFrontAddr)) {
+		t.Fatal("large request header was not routed")
+	}
+	if c := (<-got).(*Conn); c.HostName != "foo.com" {
+		t.Errorf("HostName = %q; want foo.com", c.HostName)
+	}
+}
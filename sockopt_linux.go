@@ -0,0 +1,51 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// tcpFastOpen is TCP_FASTOPEN from linux/tcp.h, which the syscall
+// package doesn't define.
+const tcpFastOpen = 0x17
+
+// controlListener sets the listener socket options requested on p.
+func (p *Proxy) controlListener(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if p.FastOpenQueueLen > 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, p.FastOpenQueueLen); err != nil {
+				sockErr = os.NewSyscallError("setsockopt TCP_FASTOPEN", err)
+				return
+			}
+		}
+		if p.DeferAccept > 0 {
+			// TCP_DEFER_ACCEPT takes whole seconds; round up so a
+			// sub-second duration doesn't disable it.
+			secs := int((p.DeferAccept + time.Second - 1) / time.Second)
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, secs); err != nil {
+				sockErr = os.NewSyscallError("setsockopt TCP_DEFER_ACCEPT", err)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenSocketOptions(t *testing.T) {
+	p := &Proxy{
+		FastOpenQueueLen: 16,
+		DeferAccept:      1500 * time.Millisecond,
+	}
+	ln, err := p.netListen()("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	rc, err := ln.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deferSecs int
+	var getErr error
+	rc.Control(func(fd uintptr) {
+		deferSecs, getErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT)
+	})
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	// The kernel converts seconds to retransmit periods and back, so
+	// only check that it's enabled.
+	if deferSecs == 0 {
+		t.Fatal("TCP_DEFER_ACCEPT not set")
+	}
+}
+
+// acceptedListener sends the TCP conns it accepts on conns.
+type acceptedListener struct {
+	net.Listener
+	conns chan *net.TCPConn
+}
+
+func (ln acceptedListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if tc, ok := c.(*net.TCPConn); ok {
+		ln.conns <- tc
+	}
+	return c, err
+}
+
+func TestKeepAliveObservedConn(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+	accepted := make(chan *net.TCPConn, 1)
+
+	p := testProxy(t, acceptedListener{front, accepted})
+	id := p.AddRoute(testFrontAddr, &DialProxy{
+		Addr:            back.Addr().String(),
+		KeepAlivePeriod: 42 * time.Second,
+	})
+	p.SetRouteObserver(testFrontAddr, id, openObserver(func() {}))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+	toFront.Write([]byte("hi"))
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromProxy.Close()
+	// Keepalive is set before any bytes are proxied.
+	if _, err := fromProxy.Read(make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := (<-accepted).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idle int
+	var getErr error
+	rc.Control(func(fd uintptr) {
+		idle, getErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if idle != 42 {
+		t.Errorf("client conn TCP_KEEPIDLE = %d; want 42", idle)
+	}
+}
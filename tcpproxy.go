@@ -31,8 +31,9 @@
 // listeners.
 //
 // For each accepted connection, the rules for that ipPort are
-// matched, in order. If one matches (currently HTTP Host, SNI, or
-// always), then the connection is handed to the target.
+// matched, in order. If one matches (currently HTTP Host, SNI,
+// detected protocol, or always), then the connection is handed to
+// the target.
 //
 // The two predefined Target implementations are:
 //
@@ -55,13 +56,17 @@ package tcpproxy
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -73,17 +78,150 @@ import (
 // The order that routes are added in matters; each is matched in the order
 // registered.
 type Proxy struct {
+	activeConns int64 // connections in serveConn; updated atomically and first for alignment
+	panics      int64 // see Panics; updated atomically
+
 	mu      sync.Mutex
 	configs map[string]*config // ip:port => config
 
 	lns   []net.Listener
 	donec chan struct{} // closed before err
 	err   error         // any error from listening
+	stopc chan struct{} // closed by Close, stops the interface watcher
+
+	adminLn  net.Listener // listening on AdminAddr, if set
+	adminSrv *http.Server // serving AdminHandler on adminLn
+
+	namespaces map[string]*Namespace   // by name; see Namespace
+	groups     map[string]*TargetGroup // by name; see RegisterTargetGroup
+	journal    *routeJournal           // open RouteJournal, if any
+
+	auditOnce  sync.Once
+	auditTrail *auditTrail // see AuditSize
+
+	missCounts map[MissReason]int64 // connections matching no route; see MissCounts
+
+	templated map[string]map[string]net.Listener // templated ipPort => resolved addr => listener
+	retiredLn map[net.Listener]bool              // listeners closed because their address went away
 
 	// ListenFunc optionally specifies an alternate listen
 	// function. If nil, net.Dial is used.
-	// The provided net is always "tcp".
+	// The provided net is "tcp", "tcp4" or "tcp6" as selected by
+	// IPFamily, or "unix" for listeners added with an ipPort of the
+	// form "unix:/path/to/socket".
 	ListenFunc func(net, laddr string) (net.Listener, error)
+
+	// AdminAddr optionally specifies a TCP address on which Start
+	// serves AdminHandler. Unless AdminAuth is set, the admin
+	// endpoints are unauthenticated, so this should be a loopback
+	// or otherwise trusted address. If AdminAuth has Tokens, it
+	// must be a loopback address or AdminTLSConfig must be set.
+	// If empty, no admin listener is started.
+	AdminAddr string
+
+	// AdminAuth optionally specifies the credentials required by
+	// AdminHandler. If nil, all requests are allowed.
+	AdminAuth *AdminAuth
+
+	// AdminTLSConfig optionally makes the AdminAddr listener use
+	// TLS. To authenticate clients by certificate, set its
+	// ClientAuth and ClientCAs and list the certificates in
+	// AdminAuth.ClientCerts.
+	AdminTLSConfig *tls.Config
+
+	// AdminDebug adds profiling and variable endpoints to
+	// AdminHandler, for diagnosing production incidents. When
+	// AdminAuth is set, they require a Debug grant.
+	AdminDebug bool
+
+	// RouteJournal optionally names a file in which routes added
+	// and removed through the admin API are recorded. Start
+	// restores the routes recorded there, with their ids, so they
+	// survive restarts, before opening listeners. Routes that can no
+	// longer be restored are logged and kept in the journal.
+	// If empty, admin API changes are lost on restart.
+	RouteJournal string
+
+	// CanonicalizeName optionally specifies how SNI and HTTP Host
+	// names are normalized before they are passed to matchers and
+	// dynamic lookups, and recorded in Conn.HostName.
+	// If nil, CanonicalName is used.
+	CanonicalizeName func(name string) string
+
+	// RawNames disables name canonicalization, so matchers see the
+	// names exactly as sent by clients.
+	RawNames bool
+
+	// AuditSize optionally specifies how many of the most recent
+	// routing decisions to keep for AuditTrail and the admin API.
+	// If zero, no decisions are kept.
+	AuditSize int
+
+	// MaxSniffSize optionally specifies how many bytes of a new
+	// connection the proxy buffers while looking for something to
+	// route on, such as a TLS ClientHello or HTTP request header.
+	// Routing headers that don't fit can't be matched. It is at
+	// least 16 bytes. If zero, 4096 bytes are buffered.
+	MaxSniffSize int
+
+	// SniffTimeout optionally limits how long the proxy waits for
+	// a new connection to send enough to be routed.
+	// If zero, there is no limit.
+	SniffTimeout time.Duration
+
+	// OnMiss optionally specifies a function to call with each
+	// connection that matches no route, and why, before it is
+	// closed. Connections sent to a listener's default target
+	// aren't misses.
+	OnMiss func(c net.Conn, reason MissReason)
+
+	// Resolver optionally specifies how DialProxy targets without
+	// a Resolver of their own resolve backend host names.
+	// If nil, their dial functions resolve names themselves.
+	Resolver *Resolver
+
+	// ScanGuard optionally bans clients that make many connections
+	// matching no route, such as port scanners, and throttles the
+	// logging of unmatched connections.
+	ScanGuard *ScanGuard
+
+	// IPFamily optionally restricts the proxy's TCP listeners to
+	// IPv4 or IPv6, or forces wildcard listeners to be dual-stack.
+	// Client addresses are keyed in their IPv4 form when a
+	// dual-stack listener reports them as v4-mapped IPv6 addresses.
+	IPFamily IPFamily
+
+	// FastOpenQueueLen optionally enables TCP Fast Open on the
+	// proxy's TCP listeners, allowing up to this many pending Fast
+	// Open requests. It is only supported on Linux, and is ignored
+	// if ListenFunc is set.
+	FastOpenQueueLen int
+
+	// DeferAccept optionally asks the kernel to hold new TCP
+	// connections until the client has sent data (such as a TLS
+	// ClientHello), or until DeferAccept has elapsed. This avoids
+	// waking the proxy for connections that haven't sent anything
+	// to route on yet. It is only supported on Linux, and is
+	// ignored if ListenFunc is set.
+	DeferAccept time.Duration
+
+	// InterfaceRefresh optionally specifies how often to re-resolve
+	// templated listener addresses (see AddRoute), opening
+	// listeners on newly assigned addresses and closing those
+	// whose address went away.
+	// If zero, templated addresses are only resolved by Start.
+	InterfaceRefresh time.Duration
+
+	// PreDial optionally starts dialing the backend of a matching
+	// AddSNIRoute as soon as the TLS ClientHello has been parsed,
+	// overlapping the dial with the evaluation of the listener's
+	// routes. If a different route ends up winning, the pre-dialed
+	// connection is closed unused.
+	//
+	// Only routes added with AddSNIRoute whose dest is a
+	// *DialProxy, and that only other AddSNIRoute routes precede,
+	// are pre-dialed, so that the guess can't be wrong.
+	PreDial bool
 }
 
 //
@@ -102,10 +240,16 @@ type Matcher func(ctx context.Context, hostname string) bool
 // - otherwise returns an ip:port string and nil if a match is found
 type TargetLookup func(ctx context.Context, hostname string) (string, error)
 
-// equals is a trivial Matcher that implements string equality.
+// equals is a trivial Matcher that implements string equality. The
+// wanted name is canonicalized the same way as the names it is
+// compared to.
 func equals(want string) Matcher {
-	return func(_ context.Context, got string) bool {
-		return want == got
+	canonWant := CanonicalName(want)
+	return func(ctx context.Context, got string) bool {
+		if standardNames(ctx) {
+			return canonWant == got
+		}
+		return canonicalName(ctx, want) == got
 	}
 }
 
@@ -124,6 +268,12 @@ type config struct {
 	stopACME bool // if true, AddSNIRoute doesn't add targets to acmeTargets.
 
 	defaultTarget Target
+	bannerWait    time.Duration // how long to wait for the client to speak first; see SetBannerWait
+
+	preDialHints map[string]preDialHint // sni => first exact SNI route's DialProxy
+	observers    map[uuid.UUID]Observer
+	shedHandlers map[uuid.UUID]func(net.Conn) // see SetRouteShedHandler
+	routeNames   map[uuid.UUID]string         // exact SNI or Host a route matches, for DumpConfig
 }
 
 func (c *config) AddRoute(r route) uuid.UUID {
@@ -146,19 +296,72 @@ func (c *config) Routes() []routeWithId {
 	return c.routes
 }
 
-func (c *config) RemoveRouteById(routeId uuid.UUID) {
+// RemoveRouteById removes the routes with id routeId and returns
+// their targets.
+func (c *config) RemoveRouteById(routeId uuid.UUID) []Target {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	var newRoutes []routeWithId
+	var removed []Target
 
 	for _, i := range c.routes {
 		if i.Id != routeId {
 			newRoutes = append(newRoutes, i)
+		} else if t := routeTarget(i.Route); t != nil {
+			removed = append(removed, t)
 		}
 	}
 
 	c.routes = newRoutes
+
+	for sni, hint := range c.preDialHints {
+		if hint.id == routeId {
+			delete(c.preDialHints, sni)
+		}
+	}
+	delete(c.observers, routeId)
+	delete(c.shedHandlers, routeId)
+	delete(c.routeNames, routeId)
+	return removed
+}
+
+// routeForName returns the id of a route on the ipPort listener
+// that matches exactly name, if there is one.
+func (p *Proxy) routeForName(ipPort, name string) (uuid.UUID, bool) {
+	p.mu.Lock()
+	cfg := p.configs[ipPort]
+	p.mu.Unlock()
+	if cfg == nil {
+		return uuid.Nil, false
+	}
+	name = CanonicalName(name)
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	for id, n := range cfg.routeNames {
+		if CanonicalName(n) == name {
+			return id, true
+		}
+	}
+	return uuid.Nil, false
+}
+
+// hasListener reports whether the ipPort listener has been
+// configured, by adding a route or default target to it.
+func (p *Proxy) hasListener(ipPort string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.configs[ipPort] != nil
+}
+
+// setRouteName records the exact name routeId matches, for display.
+func (c *config) setRouteName(routeId uuid.UUID, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.routeNames == nil {
+		c.routeNames = make(map[uuid.UUID]string)
+	}
+	c.routeNames[routeId] = name
 }
 
 type routeWithId struct {
@@ -177,14 +380,24 @@ type route interface {
 	// can only Peek.
 	//
 	// If an sni or host header was parsed successfully, that will be
-	// returned as the second parameter.
-	match(*bufio.Reader) (Target, string)
+	// returned as the second parameter, canonicalized as described by
+	// ctx (see canonicalName).
+	match(ctx context.Context, br *bufio.Reader) (Target, string)
 }
 
 func (p *Proxy) netListen() func(net, laddr string) (net.Listener, error) {
 	if p.ListenFunc != nil {
 		return p.ListenFunc
 	}
+	if p.FastOpenQueueLen > 0 || p.DeferAccept > 0 {
+		return func(network, laddr string) (net.Listener, error) {
+			lc := net.ListenConfig{}
+			if strings.HasPrefix(network, "tcp") {
+				lc.Control = p.controlListener
+			}
+			return lc.Listen(context.Background(), network, laddr)
+		}
+	}
 	return net.Listen
 }
 
@@ -201,6 +414,24 @@ func (p *Proxy) configFor(ipPort string) *config {
 	return p.configs[ipPort]
 }
 
+// ShareRoutes makes the ipPort listener use the same route table as
+// the from listener. Routes added to or removed from either ipPort
+// afterwards apply to both, so a group of listeners (for example :443
+// on several addresses, plus a unix socket) can be managed as one.
+//
+// ShareRoutes returns an error if ipPort already has its own routes.
+func (p *Proxy) ShareRoutes(ipPort, from string) error {
+	cfg := p.configFor(from)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing := p.configs[ipPort]; existing != nil && existing != cfg {
+		return fmt.Errorf("tcpproxy: listener %q already has its own routes", ipPort)
+	}
+	p.configs[ipPort] = cfg
+	return nil
+}
+
 func (p *Proxy) configExists(ipPort string) bool {
 	return p.configs[ipPort] != nil
 }
@@ -215,11 +446,12 @@ func (p *Proxy) addRouteWithId(ipPort string, r route, id uuid.UUID) {
 	cfg.AddRouteWithId(r, id)
 }
 
-func (p *Proxy) removeRouteById(ipPort string, routeId uuid.UUID) {
+func (p *Proxy) removeRouteById(ipPort string, routeId uuid.UUID) []Target {
 	if p.configExists(ipPort) {
 		cfg := p.configFor(ipPort)
-		cfg.RemoveRouteById(routeId)
+		return cfg.RemoveRouteById(routeId)
 	}
+	return nil
 }
 
 // AddRoute appends an always-matching route to the ipPort listener,
@@ -228,16 +460,23 @@ func (p *Proxy) removeRouteById(ipPort string, routeId uuid.UUID) {
 // This is generally used as either the only rule (for simple TCP
 // proxies), or as the final fallback rule for an ipPort.
 //
-// The ipPort is any valid net.Listen TCP address.
+// The ipPort is any valid net.Listen TCP address. Unix socket
+// listeners are named "unix:" followed by the socket path. The host
+// part may also be a network interface name, such as "eth0:443", or
+// "any-private" to listen on every private address of the host;
+// these are resolved to concrete addresses by Start.
 func (p *Proxy) AddRoute(ipPort string, dest Target) uuid.UUID {
 	return p.addRoute(ipPort, fixedTarget{dest})
 }
 
 // RemoveRoute removes the specified target from the ipPort listener
 //
-// This method won't remove an ipPort listener if there are no routes remaining
+// This method won't remove an ipPort listener if there are no routes remaining.
+// Warm connections of a removed DialProxy that no other route uses
+// are closed.
 func (p *Proxy) RemoveRouteById(ipPort string, routeId uuid.UUID) {
-	p.removeRouteById(ipPort, routeId)
+	p.closeUnusedPools(p.removeRouteById(ipPort, routeId))
+	p.releaseRoute(routeId)
 }
 
 func (p *Proxy) SetDefaultTarget(ipPort string, dest Target) {
@@ -249,7 +488,7 @@ type fixedTarget struct {
 	t Target
 }
 
-func (m fixedTarget) match(*bufio.Reader) (Target, string) { return m.t, "" }
+func (m fixedTarget) match(context.Context, *bufio.Reader) (Target, string) { return m.t, "" }
 
 // Run is calls Start, and then Wait.
 //
@@ -273,9 +512,19 @@ func (p *Proxy) Wait() error {
 
 // Close closes all the proxy's self-opened listeners.
 func (p *Proxy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopc != nil {
+		close(p.stopc)
+		p.stopc = nil
+	}
 	for _, c := range p.lns {
 		c.Close()
 	}
+	if p.adminSrv != nil {
+		p.adminSrv.Close()
+	}
+	p.closeJournal()
 	return nil
 }
 
@@ -289,22 +538,72 @@ func (p *Proxy) Start() error {
 	if p.donec != nil {
 		return errors.New("already started")
 	}
+	if err := p.restoreRoutes(); err != nil {
+		return err
+	}
 	p.donec = make(chan struct{})
-	errc := make(chan error, len(p.configs))
+	p.stopc = make(chan struct{})
+	errc := make(chan error, 1)
 	p.lns = make([]net.Listener, 0, len(p.configs))
 	for ipPort, config := range p.configs {
-		ln, err := p.netListen()("tcp", ipPort)
+		addrs, err := p.resolveListenAddrs(ipPort)
+		if err == nil && len(addrs) == 0 && p.InterfaceRefresh == 0 {
+			err = fmt.Errorf("tcpproxy: listener %q has no addresses", ipPort)
+		}
 		if err != nil {
 			p.Close()
 			return err
 		}
-		p.lns = append(p.lns, ln)
-		go p.serveListener(errc, ln, config)
+		for _, addr := range addrs {
+			if err := p.startListener(errc, ipPort, addr, config); err != nil {
+				p.Close()
+				return err
+			}
+		}
+	}
+	if err := p.startAdmin(); err != nil {
+		p.Close()
+		return err
+	}
+	if p.InterfaceRefresh > 0 && len(p.templated) > 0 {
+		go p.watchInterfaces(errc, p.stopc)
 	}
 	go p.awaitFirstError(errc)
 	return nil
 }
 
+// startListener listens on addr, which was resolved from the ipPort
+// listener spec, and starts serving it with cfg.
+func (p *Proxy) startListener(errc chan<- error, ipPort, addr string, cfg *config) error {
+	network, laddr := "tcp", addr
+	if strings.HasPrefix(addr, "unix:") {
+		network, laddr = "unix", strings.TrimPrefix(addr, "unix:")
+	} else {
+		var err error
+		if network, err = p.IPFamily.network(addr); err != nil {
+			return err
+		}
+	}
+	ln, err := p.netListen()(network, laddr)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopc == nil {
+		// Close was called while we were listening.
+		ln.Close()
+		return errors.New("tcpproxy: proxy closed")
+	}
+	p.lns = append(p.lns, ln)
+	if p.templated[ipPort] != nil {
+		p.templated[ipPort][addr] = ln
+	}
+	go p.serveListener(errc, ln, cfg)
+	return nil
+}
+
 func (p *Proxy) awaitFirstError(errc <-chan error) {
 	p.err = <-errc
 	close(p.donec)
@@ -314,7 +613,13 @@ func (p *Proxy) serveListener(ret chan<- error, ln net.Listener, cfg *config) {
 	for {
 		c, err := ln.Accept()
 		if err != nil {
-			ret <- err
+			if p.takeRetired(ln) {
+				return
+			}
+			select {
+			case ret <- err:
+			default: // only the first error is reported
+			}
 			return
 		}
 		go p.serveConn(c, cfg)
@@ -324,37 +629,95 @@ func (p *Proxy) serveListener(ret chan<- error, ln net.Listener, cfg *config) {
 // serveConn runs in its own goroutine and matches c against routes.
 // It returns whether it matched purely for testing.
 func (p *Proxy) serveConn(c net.Conn, cfg *config) bool {
-	br := bufio.NewReader(c)
+	atomic.AddInt64(&p.activeConns, 1)
+	defer atomic.AddInt64(&p.activeConns, -1)
+	defer p.recoverConn(c)
+	if p.ScanGuard != nil && p.ScanGuard.banned(clientIP(c)) {
+		p.recordDecision(c, nil, "", uuid.Nil, nil, MissBanned)
+		p.noteMiss(c, MissBanned)
+		c.Close()
+		return false
+	}
+	br, sr := p.newSniffReader(c)
+	clearDeadline := false
+	if cfg.bannerWait > 0 {
+		clearDeadline = true
+		c.SetReadDeadline(time.Now().Add(cfg.bannerWait))
+		// If the client stays silent, leave the deadline expired so
+		// that matchers fail fast instead of waiting for bytes that
+		// will never come. It is cleared before handing c off.
+		if _, err := br.Peek(1); err == nil {
+			c.SetReadDeadline(time.Time{})
+		}
+	}
+	if p.SniffTimeout > 0 && sr.err == nil {
+		clearDeadline = true
+		c.SetReadDeadline(time.Now().Add(p.SniffTimeout))
+	}
+	ctx := p.matchContext()
+	var pd *preDial
+	if p.PreDial {
+		pd = cfg.startPreDial(ctx, br, p.Resolver)
+	}
 	for _, routeWithId := range cfg.Routes() {
-		if target, hostName := routeWithId.Route.match(br); target != nil {
-			if n := br.Buffered(); n > 0 {
+		if target, hostName := routeWithId.Route.match(ctx, br); target != nil {
+			if pd != nil && pd.dp != target {
+				pd.discard()
+				pd = nil
+			}
+			obs := cfg.observer(routeWithId.Id)
+			shedFn := cfg.shedHandler(routeWithId.Id)
+			if n := br.Buffered(); n > 0 || obs != nil || shedFn != nil || p.Resolver != nil {
 				peeked, _ := br.Peek(br.Buffered())
-				c = &Conn{
-					HostName: hostName,
-					Peeked:   peeked,
-					Conn:     c,
+				wc := &Conn{
+					HostName:     hostName,
+					Peeked:       peeked,
+					Conn:         c,
+					preDial:      pd,
+					shed:         shedFn,
+					resolver:     p.Resolver,
+					sniffTimeout: p.SniffTimeout,
 				}
+				if obs != nil {
+					wc.Conn = observe(c, routeWithId.Id, obs, len(peeked))
+				}
+				c = wc
+			}
+			if clearDeadline {
+				c.SetReadDeadline(time.Time{})
 			}
+			p.recordDecision(c, br, hostName, routeWithId.Id, target, "")
 			target.HandleConn(c)
 			return true
 		}
 
 	}
+	if pd != nil {
+		pd.discard()
+	}
 	// TODO: hook for this?
 	if cfg.defaultTarget != nil {
 		log.Printf("tcpproxy: no matching routes found. using default target %s", cfg.defaultTarget)
-		if n := br.Buffered(); n > 0 {
+		if n := br.Buffered(); n > 0 || p.Resolver != nil {
 			peeked, _ := br.Peek(br.Buffered())
 			c = &Conn{
-				Peeked: peeked,
-				Conn:   c,
+				Peeked:       peeked,
+				Conn:         c,
+				resolver:     p.Resolver,
+				sniffTimeout: p.SniffTimeout,
 			}
 		}
+		if clearDeadline {
+			c.SetReadDeadline(time.Time{})
+		}
+		p.recordDecision(c, br, "", uuid.Nil, cfg.defaultTarget, "")
 		cfg.defaultTarget.HandleConn(c)
 		return true
-	} else {
-		log.Printf("tcpproxy: no routes matched conn %v/%v; closing", c.RemoteAddr().String(), c.LocalAddr().String())
 	}
+	reason := classifyMiss(br, sr.err)
+	p.recordDecision(c, br, "", uuid.Nil, nil, reason)
+	p.noteMiss(c, reason)
+	p.logMiss(c, reason)
 	c.Close()
 	return false
 }
@@ -381,6 +744,12 @@ type Conn struct {
 	// as needed. It should not be read from directly unless
 	// Peeked is nil.
 	net.Conn
+
+	preDial *preDial       // backend dial started before routing finished, if any
+	shed    func(net.Conn) // the route's shed handler, if any
+
+	resolver     *Resolver     // the Proxy's Resolver, if any
+	sniffTimeout time.Duration // the Proxy's SniffTimeout
 }
 
 func (c *Conn) Read(p []byte) (n int, err error) {
@@ -436,8 +805,17 @@ type DialProxy struct {
 	// net.Dialer.DialContext method is used.
 	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
 
+	// Resolver optionally specifies how to resolve the host name
+	// in Addr. If nil, the Proxy's Resolver is used for the
+	// connections it routes, and otherwise the dial function
+	// resolves the name itself. Warm connections (see WarmConns)
+	// are only dialed with this Resolver.
+	Resolver *Resolver
+
 	// OnDialError optionally specifies an alternate way to handle errors dialing Addr.
-	// If nil, the error is logged and src is closed.
+	// If nil, the error is logged and src is shed, which closes
+	// it unless its route has a shed handler (see
+	// SetRouteShedHandler).
 	// If non-nil, src is not closed automatically.
 	OnDialError func(src net.Conn, dstDialErr error)
 
@@ -449,6 +827,80 @@ type DialProxy struct {
 	// no graceful downgrade.
 	// If zero, no PROXY header is sent. Currently, version 1 is supported.
 	ProxyProtocolVersion int
+
+	// ForwardedHeaders optionally rewrites the first HTTP/1.x
+	// request of each connection to tell the backend the client's
+	// address, for backends that don't support the PROXY protocol.
+	// The client IP is appended to X-Forwarded-For, and X-Real-IP
+	// and X-Forwarded-Proto are replaced. Later requests on the same
+	// connection are not rewritten, and connections that don't
+	// start with an HTTP request are proxied unchanged. Multiple
+	// X-Forwarded-For headers are combined, in order. The rest of
+	// the request header must arrive within the Proxy's
+	// SniffTimeout, or 30 seconds if it has none.
+	ForwardedHeaders bool
+
+	// ForwardedProto is the X-Forwarded-Proto value sent when
+	// ForwardedHeaders is set.
+	// If empty, "http" is used.
+	ForwardedProto string
+
+	// WarmConns optionally specifies how many connections to Addr
+	// to keep dialed ahead of time. Each warm connection is handed
+	// to exactly one incoming connection; it is never shared
+	// between clients. This amortizes dial latency for targets
+	// that see many short-lived connections.
+	// If zero, connections are dialed on demand.
+	WarmConns int
+
+	// WarmConnMaxAge sets how long a warm connection may sit
+	// unused before it is discarded, so that backends with idle
+	// timeouts don't hand us dead connections.
+	// If zero, a default is used.
+	WarmConnMaxAge time.Duration
+
+	// IdleTimeout optionally closes connections on which no bytes
+	// have been copied in either direction for this long.
+	// If zero, connections may stay idle indefinitely.
+	IdleTimeout time.Duration
+
+	// StallTimeout optionally specifies how long data read from one
+	// side may wait to be written to the other, slow-reading side
+	// before OnStall is called. A stall is reported once until
+	// the direction makes progress again.
+	StallTimeout time.Duration
+
+	// OnStall optionally is called when a direction of src's
+	// connection stalls. dir is FromClient or FromServer, and
+	// stalled is how long it has gone without progress.
+	OnStall func(src net.Conn, dir byte, stalled time.Duration)
+
+	// OnCopyDone optionally is called with the traffic statistics
+	// of each proxied connection once copying finishes.
+	//
+	// Setting IdleTimeout, StallTimeout or OnCopyDone copies data
+	// through the proxy's own buffers, which disables the kernel
+	// splice optimization.
+	OnCopyDone func(src net.Conn, stats ConnStats)
+
+	// PortOffset optionally translates the backend port: the port
+	// dialed is the port the client connected to plus PortOffset,
+	// and the port in Addr, if any, is ignored. For example, with
+	// an offset of 8000, clients of :443 reach Addr's host on :8443.
+	PortOffset int
+
+	// PortFunc optionally chooses the backend port for src, given
+	// the port the client connected to. It can inspect src, which
+	// is a *Conn with its HostName set for SNI and HTTP routes, to
+	// pick per-tenant ports without a separate To target per
+	// tenant. The port in Addr, if any, is ignored.
+	// If non-nil, PortFunc takes precedence over PortOffset.
+	//
+	// Warm connections and pre-dialing are not used with
+	// PortOffset or PortFunc.
+	PortFunc func(src net.Conn, port int) int
+
+	pool *connPool // warm connections, if WarmConns is set; guarded by poolMu
 }
 
 // UnderlyingConn returns c.Conn if c of type *Conn,
@@ -460,18 +912,51 @@ func UnderlyingConn(c net.Conn) net.Conn {
 	return c
 }
 
-func goCloseConn(c net.Conn) { go c.Close() }
+// A wrappedConn is a net.Conn, such as one reporting to an Observer,
+// that adds behavior to the net.Conn returned by its netConn method.
+// UnderlyingConn doesn't look through them, since proxying to and
+// from the wrapped conn directly would bypass that behavior.
+type wrappedConn interface {
+	net.Conn
+	netConn() net.Conn
+}
+
+// tcpConn returns the *net.TCPConn beneath c, looking through *Conn
+// and wrappedConns, for setting socket options.
+func tcpConn(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch wc := c.(type) {
+		case *net.TCPConn:
+			return wc, true
+		case *Conn:
+			c = wc.Conn
+		case wrappedConn:
+			c = wc.netConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+func goCloseConn(c net.Conn) { go closeConn(c) }
 
 // HandleConn implements the Target interface.
 func (dp *DialProxy) HandleConn(src net.Conn) {
-	ctx := context.Background()
-	var cancel context.CancelFunc
-	if dp.DialTimeout >= 0 {
-		ctx, cancel = context.WithTimeout(ctx, dp.dialTimeout())
-	}
-	dst, err := dp.dialContext()(ctx, "tcp", dp.Addr)
-	if cancel != nil {
-		cancel()
+	var (
+		dst net.Conn
+		err error
+	)
+	r := dp.resolver(src)
+	if wc, ok := src.(*Conn); ok && wc.preDial != nil && wc.preDial.dp == dp && !dp.translatesPort() {
+		dst, err = wc.preDial.wait()
+		wc.preDial = nil
+	} else if dp.translatesPort() {
+		var addr string
+		if addr, err = dp.backendAddr(src); err == nil {
+			dst, err = dp.dialAddr(r, addr)
+		}
+	} else {
+		dst, err = dp.getConn(r)
 	}
 	if err != nil {
 		dp.onDialError()(src, err)
@@ -483,10 +968,16 @@ func (dp *DialProxy) HandleConn(src net.Conn) {
 		dp.onDialError()(src, err)
 		return
 	}
+	if dp.ForwardedHeaders {
+		if src, err = dp.sendForwardedRequest(dst, src); err != nil {
+			dp.onDialError()(src, err)
+			return
+		}
+	}
 	defer goCloseConn(src)
 
 	if ka := dp.keepAlivePeriod(); ka > 0 {
-		if c, ok := UnderlyingConn(src).(*net.TCPConn); ok {
+		if c, ok := tcpConn(src); ok {
 			c.SetKeepAlive(true)
 			c.SetKeepAlivePeriod(ka)
 		}
@@ -496,10 +987,66 @@ func (dp *DialProxy) HandleConn(src net.Conn) {
 		}
 	}
 
-	errc := make(chan error, 1)
+	if dp.instrumented() {
+		dp.copyInstrumented(src, dst)
+		return
+	}
+	errc := make(chan error, 2)
 	go proxyCopy(errc, src, dst)
 	go proxyCopy(errc, dst, src)
-	<-errc
+	err = <-errc
+	go logLateCopy(errc)
+	repanic(err)
+}
+
+// getConn returns a warm connection to dp.Addr if one is available,
+// and otherwise dials a new one, resolving its name with r if
+// non-nil.
+func (dp *DialProxy) getConn(r *Resolver) (net.Conn, error) {
+	if pool := dp.connPool(); pool != nil {
+		if c := pool.get(); c != nil {
+			return c, nil
+		}
+	}
+	return dp.dialAddr(r, dp.Addr)
+}
+
+// dial dials a new connection to dp.Addr, honoring DialTimeout.
+func (dp *DialProxy) dial() (net.Conn, error) {
+	return dp.dialAddr(dp.Resolver, dp.Addr)
+}
+
+// dialAddr dials a new connection to addr, honoring DialTimeout.
+// If r is non-nil, it resolves addr's host name.
+func (dp *DialProxy) dialAddr(r *Resolver, addr string) (net.Conn, error) {
+	ctx := context.Background()
+	if dp.DialTimeout >= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dp.dialTimeout())
+		defer cancel()
+	}
+	if r != nil {
+		return r.dial(ctx, dp.dialContext(), addr)
+	}
+	return dp.dialContext()(ctx, "tcp", addr)
+}
+
+// resolverFor returns the Resolver for dp's dials: dp.Resolver if
+// set, and otherwise def, the Proxy's Resolver.
+func (dp *DialProxy) resolverFor(def *Resolver) *Resolver {
+	if dp.Resolver != nil {
+		return dp.Resolver
+	}
+	return def
+}
+
+// resolver returns the Resolver for dialing on behalf of src.
+func (dp *DialProxy) resolver(src net.Conn) *Resolver {
+	var def *Resolver
+	if wc, ok := src.(*Conn); ok {
+		def = wc.resolver
+	}
+	return dp.resolverFor(def)
 }
 
 func (dp *DialProxy) sendProxyHeader(w io.Writer, src net.Conn) error {
@@ -520,11 +1067,15 @@ func (dp *DialProxy) sendProxyHeader(w io.Writer, src net.Conn) error {
 			return err
 		}
 
-		family := "TCP4"
-		if srcAddr.IP.To4() == nil {
-			family = "TCP6"
+		// Connections accepted by a dual-stack listener have
+		// v4-mapped addresses; report them as TCP4. The header
+		// requires both addresses to be of the same family.
+		srcIP, dstIP := unmapIP(srcAddr.IP), unmapIP(dstAddr.IP)
+		family, srcStr, dstStr := "TCP4", srcIP.String(), dstIP.String()
+		if len(srcIP) != net.IPv4len || len(dstIP) != net.IPv4len {
+			family, srcStr, dstStr = "TCP6", ipv6String(srcIP), ipv6String(dstIP)
 		}
-		_, err := fmt.Fprintf(w, "PROXY %s %s %d %s %d\r\n", family, srcAddr.IP, srcAddr.Port, dstAddr.IP, dstAddr.Port)
+		_, err := fmt.Fprintf(w, "PROXY %s %s %d %s %d\r\n", family, srcStr, srcAddr.Port, dstStr, dstAddr.Port)
 		return err
 	default:
 		return fmt.Errorf("PROXY protocol version %d not supported", dp.ProxyProtocolVersion)
@@ -535,6 +1086,8 @@ func (dp *DialProxy) sendProxyHeader(w io.Writer, src net.Conn) error {
 // It's a named function instead of a func literal so users get
 // named goroutines in debug goroutine stack dumps.
 func proxyCopy(errc chan<- error, dst, src net.Conn) {
+	defer recoverCopy(errc)
+
 	// Before we unwrap src and/or dst, copy any buffered data.
 	if wc, ok := src.(*Conn); ok && len(wc.Peeked) > 0 {
 		if _, err := dst.Write(wc.Peeked); err != nil {
@@ -560,6 +1113,13 @@ func (dp *DialProxy) keepAlivePeriod() time.Duration {
 	return time.Minute
 }
 
+func (dp *DialProxy) warmConnMaxAge() time.Duration {
+	if dp.WarmConnMaxAge > 0 {
+		return dp.WarmConnMaxAge
+	}
+	return 30 * time.Second
+}
+
 func (dp *DialProxy) dialTimeout() time.Duration {
 	if dp.DialTimeout > 0 {
 		return dp.DialTimeout
@@ -582,6 +1142,6 @@ func (dp *DialProxy) onDialError() func(src net.Conn, dstDialErr error) {
 	}
 	return func(src net.Conn, dstDialErr error) {
 		log.Printf("tcpproxy: for incoming conn %v, error dialing %q: %v", src.RemoteAddr().String(), dp.Addr, dstDialErr)
-		src.Close()
+		shed(src)
 	}
 }
@@ -17,6 +17,7 @@ package tcpproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -31,6 +32,7 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -74,7 +76,7 @@ func TestMatchHTTPHost(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			br := bufio.NewReader(tt.r)
 			r := httpHostMatch{equals(tt.host), noopTarget{}}
-			m, name := r.match(br)
+			m, name := r.match(context.Background(), br)
 			got := m != nil
 			if got != tt.want {
 				t.Fatalf("match = %v; want %v", got, tt.want)
@@ -263,6 +265,59 @@ func TestProxyAlwaysMatch(t *testing.T) {
 	}
 }
 
+func TestProxyShareRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcpproxy-share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "front.sock")
+
+	back := newLocalListener(t)
+	defer back.Close()
+
+	var p Proxy
+	if err := p.ShareRoutes("unix:"+sock, "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	// Added after sharing, via the other listener.
+	p.AddRoute("127.0.0.1:0", To(back.Addr().String()))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	toFront, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const msg = "message"
+	io.WriteString(toFront, msg)
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q; want %q", buf, msg)
+	}
+}
+
+func TestProxyShareRoutesConflict(t *testing.T) {
+	var p Proxy
+	p.AddRoute("a:1", noopTarget{})
+	p.AddRoute("b:1", noopTarget{})
+	if err := p.ShareRoutes("b:1", "a:1"); err == nil {
+		t.Fatal("ShareRoutes onto a listener with routes succeeded")
+	}
+}
+
 func TestProxyHTTP(t *testing.T) {
 	front := newLocalListener(t)
 	defer front.Close()
@@ -302,6 +357,108 @@ func TestProxyHTTP(t *testing.T) {
 	}
 }
 
+func TestProxyHTTPForwardedHeaders(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.AddHTTPHostRoute(testFrontAddr, "foo.com", &DialProxy{
+		Addr:             back.Addr().String(),
+		ForwardedHeaders: true,
+	})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	const req = "POST / HTTP/1.1\r\nHost: foo.com\r\nX-Forwarded-For: 10.9.9.9\r\nX-Real-IP: 6.6.6.6\r\nX-Forwarded-For: 10.8.8.8, 10.7.7.7\r\nContent-Length: 4\r\n\r\nbody"
+	io.WriteString(toFront, req)
+
+	fromProxy, err := back.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := toFront.LocalAddr().(*net.TCPAddr).IP.String()
+	want := "POST / HTTP/1.1\r\nHost: foo.com\r\nContent-Length: 4\r\n" +
+		"X-Forwarded-For: 10.9.9.9, 10.8.8.8, 10.7.7.7, " + ip + "\r\nX-Real-Ip: " + ip + "\r\nX-Forwarded-Proto: http\r\n\r\nbody"
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(fromProxy, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != want {
+		t.Fatalf("got %q; want %q", buf, want)
+	}
+}
+
+func TestProxyHTTPForwardedHeadersTimeout(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.SniffTimeout = 50 * time.Millisecond
+	p.AddHTTPHostRoute(testFrontAddr, "foo.com", &DialProxy{
+		Addr:             back.Addr().String(),
+		ForwardedHeaders: true,
+	})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	// Stall partway through the request header.
+	io.WriteString(toFront, "GET / HTTP/1.1\r\nHost: foo.com\r\n")
+	toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(toFront); err != nil {
+		t.Fatalf("proxy didn't give up on the request header: %v", err)
+	}
+}
+
+func TestProxyHTTPForwardedHeadersTooLarge(t *testing.T) {
+	front := newLocalListener(t)
+	defer front.Close()
+	back := newLocalListener(t)
+	defer back.Close()
+
+	p := testProxy(t, front)
+	p.AddHTTPHostRoute(testFrontAddr, "foo.com", &DialProxy{
+		Addr:             back.Addr().String(),
+		ForwardedHeaders: true,
+	})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	toFront, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toFront.Close()
+
+	// A header line longer than the limit, with no newline.
+	go io.WriteString(toFront, "GET / HTTP/1.1\r\nHost: foo.com\r\nCookie: "+strings.Repeat("x", 2*maxForwardedHeader))
+	toFront.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Closing with unread data may reset the connection.
+	if _, err := ioutil.ReadAll(toFront); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("proxy didn't reject the oversized header")
+		}
+	}
+}
+
 func TestProxySNI(t *testing.T) {
 	front := newLocalListener(t)
 	defer front.Close()
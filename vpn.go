@@ -0,0 +1,69 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import "encoding/binary"
+
+// OpenVPN opcodes a client may open a session with. The opcode is
+// the high 5 bits of the byte following the TCP length prefix; the
+// low 3 bits are the key ID, which is 0 for a new session.
+const (
+	openVPNHardResetClientV2 = 7
+	openVPNHardResetClientV3 = 10 // tls-crypt-v2
+
+	// openVPNHeaderLen is the length prefix, the opcode byte and
+	// the 8-byte session ID.
+	openVPNHeaderLen = 2 + 1 + 8
+
+	// Bounds on the length of a client's reset packet. The
+	// smallest is a bare opcode, session ID, ack array length and
+	// packet ID; tls-crypt-v2 resets carry a wrapped client key and
+	// are much larger, but still fit in a single control packet.
+	openVPNMinResetLen = 1 + 8 + 1 + 4
+	openVPNMaxResetLen = 2048
+)
+
+// isOpenVPNReset reports whether b starts with an OpenVPN-over-TCP
+// client hard reset packet, the first packet of every session.
+func isOpenVPNReset(b []byte) bool {
+	if len(b) < openVPNHeaderLen {
+		return false
+	}
+	plen := int(binary.BigEndian.Uint16(b[:2]))
+	if plen < openVPNMinResetLen || plen > openVPNMaxResetLen {
+		return false
+	}
+	if keyID := b[2] & 0x07; keyID != 0 {
+		return false
+	}
+	switch b[2] >> 3 {
+	case openVPNHardResetClientV2, openVPNHardResetClientV3:
+		return true
+	}
+	return false
+}
+
+// wireGuardInitiationLen is the fixed size of a WireGuard handshake
+// initiation message.
+const wireGuardInitiationLen = 148
+
+// IsWireGuardInitiation reports whether the datagram b is a WireGuard
+// handshake initiation message: type 1, three reserved zero bytes,
+// and exactly 148 bytes long. WireGuard only runs over UDP, so this
+// is meant for callers demultiplexing datagrams themselves.
+func IsWireGuardInitiation(b []byte) bool {
+	return len(b) == wireGuardInitiationLen &&
+		b[0] == 1 && b[1] == 0 && b[2] == 0 && b[3] == 0
+}
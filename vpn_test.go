@@ -0,0 +1,66 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// openVPNReset returns an OpenVPN-over-TCP packet with the given
+// opcode/key byte and a payload of n bytes after the session ID.
+func openVPNReset(opKey byte, n int) []byte {
+	plen := 1 + 8 + n
+	b := []byte{byte(plen >> 8), byte(plen), opKey}
+	b = append(b, 1, 2, 3, 4, 5, 6, 7, 8) // session ID
+	return append(b, make([]byte, n)...)
+}
+
+func TestDetectOpenVPN(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want Protocol
+	}{
+		{"reset-v2", openVPNReset(openVPNHardResetClientV2<<3, 5), ProtocolOpenVPN},
+		{"reset-v3", openVPNReset(openVPNHardResetClientV3<<3, 300), ProtocolOpenVPN},
+		{"nonzero-key-id", openVPNReset(openVPNHardResetClientV2<<3|1, 5), ProtocolUnknown},
+		{"control-v1", openVPNReset(4<<3, 5), ProtocolUnknown},
+		{"too-short", openVPNReset(openVPNHardResetClientV2<<3, 0), ProtocolUnknown},
+	}
+	for _, tt := range tests {
+		got := DetectProtocol(bufio.NewReader(bytes.NewReader(tt.in)))
+		if got != tt.want {
+			t.Errorf("%s: DetectProtocol = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsWireGuardInitiation(t *testing.T) {
+	msg := make([]byte, wireGuardInitiationLen)
+	msg[0] = 1
+	if !IsWireGuardInitiation(msg) {
+		t.Error("initiation message not recognized")
+	}
+	msg[0] = 2 // handshake response
+	if IsWireGuardInitiation(msg) {
+		t.Error("response message recognized as initiation")
+	}
+	msg[0] = 1
+	if IsWireGuardInitiation(msg[:100]) {
+		t.Error("short message recognized as initiation")
+	}
+}